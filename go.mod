@@ -3,8 +3,8 @@ module proxmox-talos
 go 1.24.4
 
 require (
-	github.com/TwiN/deepmerge v0.2.2
 	github.com/muhlba91/pulumi-proxmoxve/sdk/v7 v7.2.0
+	github.com/pulumi/pulumi-command/sdk v1.0.1
 	github.com/pulumi/pulumi/sdk/v3 v3.181.0
 	github.com/pulumiverse/pulumi-talos/sdk v0.6.0
 	gopkg.in/yaml.v3 v3.0.1
@@ -2,30 +2,84 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"proxmox-talos/internal/types"
 )
 
+// defaultExtensions are the official Talos system extensions baked into the image
+// when no "extensions" key is set in the stack configuration.
+var defaultExtensions = []string{
+	"siderolabs/amdgpu",
+	"siderolabs/amd-ucode",
+	"siderolabs/stargz-snapshotter",
+	"siderolabs/util-linux-tools",
+	"siderolabs/qemu-guest-agent",
+}
+
 // ClusterConfig holds all cluster configuration
+//
+// The "network" key holds either the default bridge name (Network) or a
+// static addressing block (Addressing) whose optional bridge sets Network.
 type ClusterConfig struct {
-	ControlPlaneCount int      `json:"controlPlaneCount"`
-	WorkerCount       int      `json:"workerCount"`
-	Memory            int      `json:"memory"`
-	Cores             int      `json:"cores"`
-	DiskSize          int      `json:"diskSize"`
-	Network           string   `json:"network"`
-	TalosArch         string   `json:"talosArch"`
-	TalosPlatform     string   `json:"talosPlatform"`
-	ClusterName       string   `json:"clusterName"`
-	TalosVersion      string   `json:"talosVersion"`
-	ApiVIP            string   `json:"apiVIP"`
-	Extensions        []string `json:"extensions"`
-	KubernetesVersion string   `json:"kubernetesVersion"`
+	ControlPlaneCount int                   `json:"controlPlaneCount"`
+	WorkerCount       int                   `json:"workerCount"`
+	Memory            int                   `json:"memory"`
+	Cores             int                   `json:"cores"`
+	DiskSize          int                   `json:"diskSize"`
+	Network           string                `json:"network"`
+	Addressing        *types.Network        `json:"-"`
+	NodePools         []types.NodePool      `json:"nodePools"`
+	CPUOvercommit     float64               `json:"cpuOvercommit"`
+	ImageDatastore    string                `json:"imageDatastore"`
+	ImageShared       bool                  `json:"imageShared"`
+	BootMode          types.BootMode        `json:"bootMode"`
+	TalosArch         string                `json:"talosArch"`
+	TalosPlatform     string                `json:"talosPlatform"`
+	ClusterName       string                `json:"clusterName"`
+	TalosVersion      string                `json:"talosVersion"`
+	ApiVIP            string                `json:"apiVIP"`
+	APIEndpointMode   types.APIEndpointMode `json:"apiEndpointMode"`
+	LoadBalancer      types.LoadBalancer    `json:"loadBalancer"`
+	// VIPDeviceSelector selects the control plane interface that holds the static address and the API VIP,
+	// the default interface if empty. The talos-config templates must select it the same way.
+	VIPDeviceSelector map[string]string `json:"vipDeviceSelector"`
+	// APIDNSName is the DNS name clients reach the Kubernetes API by instead of the apiVIP host.
+	APIDNSName string `json:"apiDNSName"`
+	// APIServerPort is the port the Kubernetes API server listens on on every control plane,
+	// which a load balancer forwards the endpoint to.
+	APIServerPort int `json:"apiServerPort"`
+	// CertSANs are extra IPs and hostnames the Talos and Kubernetes API certificates are valid for.
+	CertSANs []string `json:"certSANs"`
+	// CNI replaces the Flannel CNI Talos deploys by default.
+	CNI types.CNI `json:"cni"`
+	// ExtraManifests are the URLs of manifests the control planes download and apply.
+	ExtraManifests []string `json:"extraManifests"`
+	Extensions     []string `json:"extensions"`
+	// Schematics are keyed by name; the DefaultSchematic falls back to Extensions when not configured.
+	Schematics        map[string]types.Schematic `json:"schematics"`
+	KubernetesVersion string                     `json:"kubernetesVersion"`
+	// TemplateVars are user-defined variables available to the talos-config templates as .Vars.
+	TemplateVars map[string]any `json:"templateVars"`
+	// PatchInclude and PatchExclude filter the talos-config patch files by glob.
+	PatchInclude []string `json:"patchInclude"`
+	PatchExclude []string `json:"patchExclude"`
+	// TalosconfigFile is the file the talosctl client configuration is written to, none if empty.
+	TalosconfigFile string `json:"talosconfigFile"`
+	// RenderOnly writes every node's machine config to RenderDir during a preview instead of deploying.
+	// It needs a stack that was deployed before.
+	RenderOnly bool   `json:"renderOnly"`
+	RenderDir  string `json:"renderDir"`
 }
 
 // LoadConfig loads configuration from Pulumi config with sensible defaults
-func LoadConfig(ctx *pulumi.Context) *ClusterConfig {
+func LoadConfig(ctx *pulumi.Context) (*ClusterConfig, error) {
 	conf := config.New(ctx, "")
 
 	// Helper function to get int with default
@@ -44,33 +98,406 @@ func LoadConfig(ctx *pulumi.Context) *ClusterConfig {
 		return def
 	}
 
-	return &ClusterConfig{
+	extensions := defaultExtensions
+	if conf.Get("extensions") != "" {
+		extensions = nil
+		if err := conf.GetObject("extensions", &extensions); err != nil {
+			return nil, fmt.Errorf("reading extensions: %w", err)
+		}
+	}
+
+	network := getStringOrDefault("network", "vmbr1")
+	var addressing *types.Network
+	if strings.HasPrefix(strings.TrimSpace(network), "{") {
+		addressing = &types.Network{}
+		if err := conf.GetObject("network", addressing); err != nil {
+			return nil, fmt.Errorf("reading network: %w", err)
+		}
+		network = "vmbr1"
+		if addressing.Bridge != "" {
+			network = addressing.Bridge
+		}
+	}
+
+	// Static addresses reach Talos through the cloud-init drive, which only the nocloud platform reads
+	talosPlatform := "metal"
+	if addressing != nil {
+		talosPlatform = "nocloud"
+	}
+
+	cpuOvercommit := 1.0
+	if val := conf.GetFloat64("cpuOvercommit"); val != 0 {
+		cpuOvercommit = val
+	}
+
+	schematics := map[string]types.Schematic{}
+	if conf.Get("schematics") != "" {
+		if err := conf.GetObject("schematics", &schematics); err != nil {
+			return nil, fmt.Errorf("reading schematics: %w", err)
+		}
+	}
+	if _, ok := schematics[types.DefaultSchematic]; !ok {
+		schematic := types.Schematic{}
+		schematic.Customization.SystemExtensions.OfficialExtensions = extensions
+		schematics[types.DefaultSchematic] = schematic
+	}
+
+	templateVars := map[string]any{}
+	if conf.Get("templateVars") != "" {
+		if err := conf.GetObject("templateVars", &templateVars); err != nil {
+			return nil, fmt.Errorf("reading templateVars: %w", err)
+		}
+	}
+
+	var patchInclude, patchExclude []string
+	if conf.Get("patchInclude") != "" {
+		if err := conf.GetObject("patchInclude", &patchInclude); err != nil {
+			return nil, fmt.Errorf("reading patchInclude: %w", err)
+		}
+	}
+	if conf.Get("patchExclude") != "" {
+		if err := conf.GetObject("patchExclude", &patchExclude); err != nil {
+			return nil, fmt.Errorf("reading patchExclude: %w", err)
+		}
+	}
+
+	var vipDeviceSelector map[string]string
+	if conf.Get("vipDeviceSelector") != "" {
+		if err := conf.GetObject("vipDeviceSelector", &vipDeviceSelector); err != nil {
+			return nil, fmt.Errorf("reading vipDeviceSelector: %w", err)
+		}
+	}
+
+	var certSANs []string
+	if conf.Get("certSANs") != "" {
+		if err := conf.GetObject("certSANs", &certSANs); err != nil {
+			return nil, fmt.Errorf("reading certSANs: %w", err)
+		}
+	}
+
+	cni := types.CNI{Name: types.CNIFlannel}
+	if conf.Get("cni") != "" {
+		if err := conf.GetObject("cni", &cni); err != nil {
+			return nil, fmt.Errorf("reading cni: %w", err)
+		}
+	}
+	if cni.Name == types.CNICilium && cni.Version == "" {
+		cni.Version = types.DefaultCiliumVersion
+	}
+
+	var extraManifests []string
+	if conf.Get("extraManifests") != "" {
+		if err := conf.GetObject("extraManifests", &extraManifests); err != nil {
+			return nil, fmt.Errorf("reading extraManifests: %w", err)
+		}
+	}
+
+	loadBalancer := types.LoadBalancer{Dir: "loadbalancer", Interface: "eth0"}
+	if conf.Get("loadBalancer") != "" {
+		if err := conf.GetObject("loadBalancer", &loadBalancer); err != nil {
+			return nil, fmt.Errorf("reading loadBalancer: %w", err)
+		}
+	}
+
+	var nodePools []types.NodePool
+	if conf.Get("nodePools") != "" {
+		if err := conf.GetObject("nodePools", &nodePools); err != nil {
+			return nil, fmt.Errorf("reading nodePools: %w", err)
+		}
+	}
+
+	cfg := &ClusterConfig{
 		ControlPlaneCount: getIntOrDefault("controlPlaneCount", 3),
 		WorkerCount:       getIntOrDefault("workerCount", 3),
 		Memory:            getIntOrDefault("memory", 8096),
 		Cores:             getIntOrDefault("cores", 4),
 		DiskSize:          getIntOrDefault("diskSize", 100),
-		Network:           getStringOrDefault("network", "vmbr1"),
+		Network:           network,
+		Addressing:        addressing,
 		TalosArch:         getStringOrDefault("talosArch", "amd64"),
-		TalosPlatform:     getStringOrDefault("talosPlatform", "metal"),
+		TalosPlatform:     getStringOrDefault("talosPlatform", talosPlatform),
 		ClusterName:       getStringOrDefault("clusterName", "talos"),
 		TalosVersion:      getStringOrDefault("talosVersion", "v1.10.0"),
 		ApiVIP:            getStringOrDefault("apiVIP", "https://192.168.4.9:6443"),
+		APIDNSName:        conf.Get("apiDNSName"),
+		APIServerPort:     getIntOrDefault("apiServerPort", 6443),
+		CertSANs:          certSANs,
+		CNI:               cni,
+		ExtraManifests:    extraManifests,
+		APIEndpointMode:   types.APIEndpointMode(getStringOrDefault("apiEndpointMode", string(types.APIEndpointVIP))),
+		LoadBalancer:      loadBalancer,
+		VIPDeviceSelector: vipDeviceSelector,
 		KubernetesVersion: getStringOrDefault("kubernetesVersion", "v1.33.0"),
-		Extensions: []string{
-			"siderolabs/amdgpu",
-			"siderolabs/amd-ucode",
-			"siderolabs/stargz-snapshotter",
-			"siderolabs/util-linux-tools",
-			"siderolabs/qemu-guest-agent",
-		},
+		Extensions:        extensions,
+		Schematics:        schematics,
+		NodePools:         nodePools,
+		CPUOvercommit:     cpuOvercommit,
+		ImageDatastore:    getStringOrDefault("imageDatastore", "local"),
+		ImageShared:       conf.GetBool("imageShared"),
+		BootMode:          types.BootMode(getStringOrDefault("bootMode", string(types.BootModeISO))),
+		TemplateVars:      templateVars,
+		PatchInclude:      patchInclude,
+		PatchExclude:      patchExclude,
+		TalosconfigFile:   conf.Get("talosconfigFile"),
+		RenderOnly:        conf.GetBool("renderOnly"),
+		RenderDir:         getStringOrDefault("renderDir", "rendered"),
+	}
+	cfg.applyPoolDefaults()
+
+	return cfg, nil
+}
+
+// applyPoolDefaults derives the node pools from the legacy counts when none are configured
+// and fills unset pool sizing from the cluster-wide defaults.
+func (c *ClusterConfig) applyPoolDefaults() {
+	if len(c.NodePools) == 0 {
+		c.NodePools = []types.NodePool{
+			{Name: types.ControlPlane.String(), Role: types.ControlPlane.String(), Count: c.ControlPlaneCount},
+			{Name: types.Worker.String(), Role: types.Worker.String(), Count: c.WorkerCount},
+		}
+	}
+
+	for i := range c.NodePools {
+		pool := &c.NodePools[i]
+		if pool.Cores == 0 {
+			pool.Cores = c.Cores
+		}
+		if pool.Memory == 0 {
+			pool.Memory = c.Memory
+		}
+		if pool.DiskSize == 0 {
+			pool.DiskSize = c.DiskSize
+		}
+		if pool.Bridge == "" {
+			pool.Bridge = c.Network
+		}
+		if pool.Schematic == "" {
+			pool.Schematic = types.DefaultSchematic
+		}
+		if pool.Count == 0 {
+			pool.Count = len(pool.Nodes)
+		}
+	}
+}
+
+// APIHost returns the host of the Kubernetes API endpoint, empty if the endpoint is not a URL.
+func (c *ClusterConfig) APIHost() string {
+	apiURL, err := url.Parse(c.ApiVIP)
+	if err != nil {
+		return ""
+	}
+	return apiURL.Hostname()
+}
+
+// APIPort returns the port of the Kubernetes API endpoint, 6443 if the endpoint has none.
+func (c *ClusterConfig) APIPort() string {
+	apiURL, err := url.Parse(c.ApiVIP)
+	if err != nil || apiURL.Port() == "" {
+		return "6443"
+	}
+	return apiURL.Port()
+}
+
+// APIEndpoint returns the URL of the Kubernetes API endpoint: apiVIP, with the host replaced by apiDNSName if set.
+func (c *ClusterConfig) APIEndpoint() string {
+	if c.APIDNSName == "" {
+		return c.ApiVIP
 	}
+	return "https://" + net.JoinHostPort(c.APIDNSName, c.APIPort())
+}
+
+// APISANs returns the subject alternative names of the API certificates: the apiVIP host,
+// apiDNSName and the extra certSANs, without duplicates.
+func (c *ClusterConfig) APISANs() []string {
+	var sans []string
+	seen := map[string]bool{}
+	for _, san := range append([]string{c.APIHost(), c.APIDNSName}, c.CertSANs...) {
+		if san != "" && !seen[san] {
+			seen[san] = true
+			sans = append(sans, san)
+		}
+	}
+	return sans
+}
+
+// VIP returns the IP of the apiVIP host, or an invalid address if the host is not an IP.
+func (c *ClusterConfig) VIP() netip.Addr {
+	vip, err := netip.ParseAddr(c.APIHost())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return vip
+}
+
+// PoolsByType returns the node pools with the given role.
+func (c *ClusterConfig) PoolsByType(nodeType types.NodeType) []*types.NodePool {
+	var pools []*types.NodePool
+	for i := range c.NodePools {
+		if t, err := c.NodePools[i].Type(); err == nil && t == nodeType {
+			pools = append(pools, &c.NodePools[i])
+		}
+	}
+	return pools
+}
+
+// NodeCount returns the total number of nodes with the given role across all pools.
+func (c *ClusterConfig) NodeCount(nodeType types.NodeType) int {
+	count := 0
+	for _, pool := range c.PoolsByType(nodeType) {
+		count += pool.Count
+	}
+	return count
 }
 
 // Validate checks if the configuration is valid
 func (c *ClusterConfig) Validate() error {
-	if c.ControlPlaneCount%2 == 0 {
-		return fmt.Errorf("control plane count must be odd, got %d", c.ControlPlaneCount)
+	names := map[string]bool{}
+	nodeNames := map[string]bool{}
+	for i := range c.NodePools {
+		pool := &c.NodePools[i]
+		if err := pool.Validate(); err != nil {
+			return err
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("duplicate node pool name %s", pool.Name)
+		}
+		names[pool.Name] = true
+		for _, node := range pool.Nodes {
+			if nodeNames[node] {
+				return fmt.Errorf("node %s is pinned more than once", node)
+			}
+			nodeNames[node] = true
+		}
+		if _, ok := c.Schematics[pool.Schematic]; !ok {
+			return fmt.Errorf("node pool %s uses unknown schematic %s", pool.Name, pool.Schematic)
+		}
+	}
+
+	for name, schematic := range c.Schematics {
+		if err := schematic.Validate(); err != nil {
+			return fmt.Errorf("schematic %s: %w", name, err)
+		}
+	}
+
+	if err := c.CNI.Validate(); err != nil {
+		return err
+	}
+
+	for _, manifest := range c.ExtraManifests {
+		manifestURL, err := url.Parse(manifest)
+		if err != nil || (manifestURL.Scheme != "http" && manifestURL.Scheme != "https") || manifestURL.Host == "" {
+			return fmt.Errorf("extra manifest %q must be an http or https URL", manifest)
+		}
+	}
+
+	if err := c.BootMode.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.APIEndpointMode.Validate(); err != nil {
+		return err
+	}
+	if c.APIHost() == "" {
+		return fmt.Errorf("apiVIP %q must be a URL like https://192.168.4.9:6443", c.ApiVIP)
+	}
+	if c.APIDNSName != "" {
+		if _, err := netip.ParseAddr(c.APIDNSName); err == nil || !isHostname(c.APIDNSName) {
+			return fmt.Errorf("apiDNSName %q must be a DNS name", c.APIDNSName)
+		}
+	}
+	for _, san := range c.CertSANs {
+		if _, err := netip.ParseAddr(san); err != nil && !isHostname(strings.TrimPrefix(san, "*.")) {
+			return fmt.Errorf("certSAN %q must be an IP or a hostname", san)
+		}
+	}
+	if c.APIEndpointMode == types.APIEndpointHAProxy && (c.LoadBalancer.Dir == "" || c.LoadBalancer.Interface == "") {
+		return fmt.Errorf("api endpoint mode %s needs loadBalancer dir and interface", c.APIEndpointMode)
+	}
+	// The load balancer must be running before the cluster bootstraps, so it is configured with the
+	// control plane addresses before their VMs exist
+	if c.APIEndpointMode == types.APIEndpointHAProxy && c.Addressing == nil {
+		return fmt.Errorf("api endpoint mode %s needs addressing", c.APIEndpointMode)
+	}
+	if c.APIServerPort < 1 || c.APIServerPort > 65535 {
+		return fmt.Errorf("apiServerPort must be between 1 and 65535, got %d", c.APIServerPort)
+	}
+	// The Talos VIP serves the endpoint on the API server itself
+	if c.APIEndpointMode == types.APIEndpointVIP && c.APIPort() != strconv.Itoa(c.APIServerPort) {
+		return fmt.Errorf("apiVIP port %s must be the apiServerPort %d in api endpoint mode %s", c.APIPort(), c.APIServerPort, c.APIEndpointMode)
+	}
+
+	if err := types.CheckKubernetesCompatibility(c.TalosVersion, c.KubernetesVersion); err != nil {
+		return err
+	}
+
+	if c.Addressing != nil {
+		if err := c.Addressing.Validate(); err != nil {
+			return err
+		}
+		if c.TalosPlatform != "nocloud" {
+			return fmt.Errorf("static network addressing requires talosPlatform nocloud, got %s", c.TalosPlatform)
+		}
+		// Only the layer-2 VIP must live in the node network, a load balancer can be anywhere
+		if c.APIEndpointMode == types.APIEndpointVIP {
+			if err := c.validateVIP(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.CPUOvercommit < 1 {
+		return fmt.Errorf("cpu overcommit must be at least 1, got %g", c.CPUOvercommit)
+	}
+
+	controlPlaneCount := c.NodeCount(types.ControlPlane)
+	if controlPlaneCount < 1 {
+		return fmt.Errorf("control plane count must be at least 1, got %d", controlPlaneCount)
+	}
+	if controlPlaneCount%2 == 0 {
+		return fmt.Errorf("control plane count must be odd, got %d", controlPlaneCount)
+	}
+	return nil
+}
+
+// validateVIP checks that the API VIP is a free address of the node subnet.
+func (c *ClusterConfig) validateVIP() error {
+	vip := c.VIP()
+	if !vip.IsValid() {
+		// A DNS name is resolved outside of the cluster network
+		return nil
+	}
+
+	prefix, err := c.Addressing.Prefix()
+	if err != nil {
+		return err
+	}
+	if !prefix.Contains(vip) {
+		return fmt.Errorf("apiVIP %s is outside the node network %s", vip, prefix)
+	}
+	if vip == prefix.Addr() {
+		return fmt.Errorf("apiVIP %s is the network address of %s", vip, prefix)
+	}
+	if gateway, err := netip.ParseAddr(c.Addressing.Gateway); err == nil && vip == gateway {
+		return fmt.Errorf("apiVIP %s is the network gateway", vip)
 	}
 	return nil
 }
+
+// isHostname returns true for an RFC 1123 hostname.
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -2,25 +2,56 @@ package deployment
 
 import (
 	"fmt"
-	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/cluster"
+	"net"
+	"strings"
+
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/download"
+	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/vm"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
-	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/imagefactory"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/machine"
 	internalConfig "proxmox-talos/internal/config"
+	"proxmox-talos/internal/identity"
+	"proxmox-talos/internal/ipam"
+	"proxmox-talos/internal/placement"
 	"proxmox-talos/internal/types"
 	talosCluster "proxmox-talos/internal/types/talos/cluster"
+	"proxmox-talos/pkg/loadbalancer"
 	"proxmox-talos/pkg/proxmox"
 	"proxmox-talos/pkg/talos"
-	"strings"
 )
 
+// nodeAddressesOutput is the stack output that persists the static node addresses
+const nodeAddressesOutput = "NodeAddresses"
+
+// nodeIdentitiesOutput is the stack output that persists the node names of every pool
+const nodeIdentitiesOutput = "NodeIdentities"
+
+// bootstrapNodeOutput is the stack output that persists the name of the bootstrap node
+const bootstrapNodeOutput = "BootstrapNode"
+
+// vmPlacementOutput is the stack output that persists the Proxmox host of every node's VM
+const vmPlacementOutput = "VMPlacement"
+
 // Pipeline represents the deployment pipeline
 type Pipeline struct {
 	ctx     *pulumi.Context
 	config  *internalConfig.ClusterConfig
 	cluster *talosCluster.Cluster
 	proxmox *proxmox.Proxmox
+	images  map[string]*talos.Image
+	// applied holds the configuration apply of every node once Talos is deployed
+	applied map[string]pulumi.Resource
+	// stackRef references the last deployment of this stack to keep allocations stable
+	stackRef *pulumi.StackReference
+	// retiredBootstrap is the bootstrap node of the last deployment if it was removed
+	retiredBootstrap string
+	// creds are the Proxmox credentials of the provider
+	creds *proxmox.Credentials
+	// isoAttached holds the VM of every node that boots the ISO in this deployment
+	isoAttached map[string]*vm.VirtualMachine
+	// health resolves once the cluster is healthy
+	health pulumi.Output
 }
 
 // NewPipeline creates a new deployment pipeline
@@ -33,8 +64,12 @@ func NewPipeline(ctx *pulumi.Context, cfg *internalConfig.ClusterConfig) (*Pipel
 		cfg.ClusterName,
 		cfg.TalosVersion,
 		cfg.KubernetesVersion,
-		cfg.ApiVIP,
+		cfg.APIEndpoint(),
 	)
+	// Behind a load balancer the endpoint only forwards the Kubernetes API, the Talos VIP serves both
+	if cfg.APIDNSName != "" && cfg.APIEndpointMode == types.APIEndpointVIP {
+		cluster.ClientEndpoints = []string{cfg.APIDNSName}
+	}
 
 	return &Pipeline{
 		ctx:     ctx,
@@ -45,10 +80,25 @@ func NewPipeline(ctx *pulumi.Context, cfg *internalConfig.ClusterConfig) (*Pipel
 
 // Execute runs the complete deployment pipeline
 func (p *Pipeline) Execute() error {
+	if p.config.RenderOnly {
+		if err := p.render(); err != nil {
+			return fmt.Errorf("rendering machine configs failed: %w", err)
+		}
+		return nil
+	}
+
+	if err := p.checkUpgrade(); err != nil {
+		return fmt.Errorf("upgrade check failed: %w", err)
+	}
+
 	if err := p.setupCluster(); err != nil {
 		return fmt.Errorf("cluster setup failed: %w", err)
 	}
 
+	if err := p.configureLoadBalancer(); err != nil {
+		return fmt.Errorf("load balancer configuration failed: %w", err)
+	}
+
 	if err := p.setupProxmox(); err != nil {
 		return fmt.Errorf("proxmox setup failed: %w", err)
 	}
@@ -57,25 +107,76 @@ func (p *Pipeline) Execute() error {
 		return fmt.Errorf("infrastructure creation failed: %w", err)
 	}
 
+	if err := p.configureAPIEndpoint(); err != nil {
+		return fmt.Errorf("api endpoint configuration failed: %w", err)
+	}
+
 	if err := p.deployTalos(); err != nil {
 		return fmt.Errorf("talos deployment failed: %w", err)
 	}
 
+	if err := p.upgradeCluster(); err != nil {
+		return fmt.Errorf("cluster upgrade failed: %w", err)
+	}
+
 	if err := p.generateOutputs(); err != nil {
 		return fmt.Errorf("output generation failed: %w", err)
 	}
 
+	if err := p.detachISOs(); err != nil {
+		return fmt.Errorf("detaching the talos ISO failed: %w", err)
+	}
+
 	return nil
 }
 
-// setupCluster initializes the cluster configuration
-func (p *Pipeline) setupCluster() error {
-	if err := p.cluster.GenerateNodes(p.config.ControlPlaneCount, types.ControlPlane); err != nil {
-		return fmt.Errorf("generating control plane nodes: %w", err)
+// render writes the machine config of every node to the render directory without creating any resources.
+// It only runs during a preview, since an update without resources would destroy the deployed cluster.
+func (p *Pipeline) render() error {
+	if !p.ctx.DryRun() {
+		return fmt.Errorf("renderOnly only renders during pulumi preview, refusing to update the stack")
 	}
 
-	if err := p.cluster.GenerateNodes(p.config.WorkerCount, types.Worker); err != nil {
-		return fmt.Errorf("generating worker nodes: %w", err)
+	if err := p.generateNodes(); err != nil {
+		return err
+	}
+
+	var secrets *machine.MachineSecrets
+	if err := p.previousOutput(talos.MachineSecretsOutput, &secrets); err != nil {
+		return err
+	}
+	var schematicIDs map[string]string
+	if err := p.previousOutput(talos.SchematicIDsOutput, &schematicIDs); err != nil {
+		return err
+	}
+	running, err := p.runningKubernetesVersion()
+	if err != nil {
+		return err
+	}
+
+	renderer, err := talos.NewRenderer(p.ctx, p.cluster, p.config, secrets, schematicIDs)
+	if err != nil {
+		return err
+	}
+	if running != "" {
+		renderer.SetKubernetesVersion(running)
+	}
+	return renderer.Render(p.config.RenderDir)
+}
+
+// checkUpgrade refuses a Kubernetes version change the cluster cannot make before any resource is touched
+func (p *Pipeline) checkUpgrade() error {
+	running, err := p.runningKubernetesVersion()
+	if err != nil {
+		return err
+	}
+	return talos.NewKubernetesUpgrader(p.ctx, p.cluster, running).Check()
+}
+
+// setupCluster initializes the cluster configuration
+func (p *Pipeline) setupCluster() error {
+	if err := p.generateNodes(); err != nil {
+		return err
 	}
 
 	if err := p.cluster.GenerateMachineSecrets(p.ctx); err != nil {
@@ -83,14 +184,192 @@ func (p *Pipeline) setupCluster() error {
 	}
 
 	p.ctx.Log.Info(fmt.Sprintf("Generated Talos Cluster: %s", p.cluster.String()), nil)
+	p.ctx.Export(talos.MachineSecretsOutput, pulumi.ToSecret(p.cluster.MachineSecrets.MachineSecrets))
+	return nil
+}
+
+// generateNodes creates the nodes of every pool with stable names, a bootstrap node and their addresses
+func (p *Pipeline) generateNodes() error {
+	var previous map[string][]string
+	if err := p.previousOutput(nodeIdentitiesOutput, &previous); err != nil {
+		return err
+	}
+
+	identities := map[string][]string{}
+	for _, nodeType := range []types.NodeType{types.ControlPlane, types.Worker} {
+		for _, pool := range p.config.PoolsByType(nodeType) {
+			names := identity.Names(p.cluster.Name, pool, previous[pool.Name])
+			if err := p.cluster.GenerateNodes(pool, names); err != nil {
+				return fmt.Errorf("generating nodes for pool %s: %w", pool.Name, err)
+			}
+			identities[pool.Name] = names
+		}
+	}
+	p.ctx.Export(nodeIdentitiesOutput, pulumi.ToStringArrayMap(identities))
+
+	if err := p.assignBootstrap(); err != nil {
+		return fmt.Errorf("assigning bootstrap node: %w", err)
+	}
+
+	if err := p.checkScaleIn(); err != nil {
+		return fmt.Errorf("checking scale-in: %w", err)
+	}
+
+	if err := p.allocateAddresses(); err != nil {
+		return fmt.Errorf("allocating node addresses: %w", err)
+	}
+
+	return nil
+}
+
+// assignBootstrap keeps the bootstrap role on the node of the last deployment. If that node is gone,
+// the role moves to the first control plane that was already installed, or to a new one.
+func (p *Pipeline) assignBootstrap() error {
+	var previous string
+	if err := p.previousOutput(bootstrapNodeOutput, &previous); err != nil {
+		return err
+	}
+	var installed []string
+	if err := p.previousOutput(talos.InstalledNodesOutput, &installed); err != nil {
+		return err
+	}
+
+	isInstalled := map[string]bool{}
+	for _, name := range installed {
+		isInstalled[name] = true
+	}
+
+	var candidate types.Node
+	for _, node := range p.cluster.Nodes {
+		if node.Type() != types.ControlPlane {
+			continue
+		}
+		if node.Name() == previous {
+			candidate = node
+			break
+		}
+		if candidate == nil || (isInstalled[node.Name()] && !isInstalled[candidate.Name()]) {
+			candidate = node
+		}
+	}
+	if candidate == nil {
+		return fmt.Errorf("cluster has no control plane")
+	}
+
+	if previous != "" && candidate.Name() != previous {
+		p.ctx.Log.Info(fmt.Sprintf("Bootstrap node %s is gone, moving the bootstrap role to %s", previous, candidate.Name()), nil)
+		p.retiredBootstrap = previous
+	}
+	if err := p.cluster.SetBootstrapNode(candidate.Name()); err != nil {
+		return err
+	}
+
+	p.ctx.Export(bootstrapNodeOutput, pulumi.String(candidate.Name()))
+	return nil
+}
+
+// checkScaleIn refuses to remove as many control planes as etcd needs for quorum in one deployment
+func (p *Pipeline) checkScaleIn() error {
+	var previous []string
+	if err := p.previousOutput(talos.ControlPlaneNodesOutput, &previous); err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	for _, node := range p.cluster.Nodes {
+		if node.Type() == types.ControlPlane {
+			current[node.Name()] = true
+		}
+	}
+
+	var removed []string
+	for _, name := range previous {
+		if !current[name] {
+			removed = append(removed, name)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	quorum := len(previous)/2 + 1
+	if len(previous)-len(removed) < quorum {
+		return fmt.Errorf("removing control planes %v would leave %d of %d etcd members, below the quorum of %d; scale in over several deployments",
+			removed, len(previous)-len(removed), len(previous), quorum)
+	}
+
+	p.ctx.Log.Info(fmt.Sprintf("Decommissioning control planes %v", removed), nil)
+	return nil
+}
+
+// allocateAddresses assigns every node a static address, keeping the addresses of the last deployment
+func (p *Pipeline) allocateAddresses() error {
+	if p.config.Addressing == nil {
+		return nil
+	}
+
+	allocator, err := ipam.NewAllocator(p.config.Addressing)
+	if err != nil {
+		return err
+	}
+
+	// Never hand out the API VIP to a node
+	vip := p.config.VIP()
+	if vip.IsValid() {
+		allocator.Reserve(vip)
+	}
+
+	var previous map[string]string
+	if err := p.previousOutput(nodeAddressesOutput, &previous); err != nil {
+		return err
+	}
+
+	// Only keep the addresses of nodes that still exist, so removed nodes release theirs
+	current := map[string]string{}
+	for _, node := range p.cluster.Nodes {
+		if address, ok := previous[node.Name()]; ok {
+			// Restore drops reserved addresses, which would silently renumber the node
+			if vip.IsValid() && address == vip.String() {
+				return fmt.Errorf("node %s holds the API VIP %s, choose another apiVIP", node.Name(), vip)
+			}
+			current[node.Name()] = address
+		}
+	}
+	allocator.Restore(current)
+
+	for _, node := range p.cluster.Nodes {
+		addr, err := allocator.Allocate(node.Name())
+		if err != nil {
+			return err
+		}
+		node.SetAddress(allocator.Prefix(addr).String())
+		p.ctx.Log.Info(fmt.Sprintf("Node %s has address %s", node.Name(), node.Address()), nil)
+	}
+
+	p.ctx.Export(nodeAddressesOutput, pulumi.ToStringMap(allocator.Allocations()))
 	return nil
 }
 
 // setupProxmox initializes the Proxmox provider
 func (p *Pipeline) setupProxmox() error {
-	conf := config.New(p.ctx, "")
-	var err error
-	p.proxmox, err = proxmox.NewProxmox(p.ctx, conf)
+	creds, err := proxmox.LoadCredentials(config.New(p.ctx, ""))
+	if err != nil {
+		return fmt.Errorf("loading proxmox credentials: %w", err)
+	}
+
+	// A CA bundle is checked regardless of the privilege check, the provider must trust it as well
+	if err := proxmox.VerifyTLS(p.ctx, creds); err != nil {
+		return fmt.Errorf("verifying proxmox TLS: %w", err)
+	}
+
+	if creds.VerifyPrivileges {
+		if err := proxmox.VerifyAccess(p.ctx, creds, p.proxmoxRequirements()); err != nil {
+			return fmt.Errorf("verifying proxmox access: %w", err)
+		}
+	}
+
+	p.creds = creds
+	p.proxmox, err = proxmox.NewProxmox(p.ctx, creds)
 	if err != nil {
 		return fmt.Errorf("creating proxmox client: %w", err)
 	}
@@ -102,49 +381,134 @@ func (p *Pipeline) setupProxmox() error {
 	return nil
 }
 
+// proxmoxRequirements returns the datastores and bridges the deployment uses and whether it uses cloud-init.
+func (p *Pipeline) proxmoxRequirements() proxmox.Requirements {
+	req := proxmox.Requirements{
+		DiskDatastores:  []string{proxmox.DiskDatastore},
+		ImageDatastores: []string{p.config.ImageDatastore},
+		CloudInit:       p.config.Addressing != nil,
+	}
+	seen := map[string]bool{}
+	for _, pool := range p.config.NodePools {
+		if !seen[pool.Bridge] {
+			seen[pool.Bridge] = true
+			req.Bridges = append(req.Bridges, pool.Bridge)
+		}
+	}
+	return req
+}
+
 // createInfrastructure creates VMs and downloads images
 func (p *Pipeline) createInfrastructure() error {
-	// Create Talos image
-	talosImage, err := talos.CreateTalosImage(p.ctx, p.config)
+	// Create Talos images
+	images, err := talos.CreateTalosImages(p.ctx, p.config)
 	if err != nil {
-		return fmt.Errorf("creating talos image: %w", err)
+		return fmt.Errorf("creating talos images: %w", err)
 	}
+	p.images = images
 
-	// Download image to Proxmox
-	downloadedImage, err := p.proxmox.DownloadTalosImage(p.ctx, talosImage)
+	// Place VMs on Proxmox hosts
+	plan, err := p.placeVMs()
 	if err != nil {
-		return fmt.Errorf("downloading talos image: %w", err)
+		return fmt.Errorf("placing VMs: %w", err)
+	}
+
+	// Download every image to the Proxmox hosts that receive a VM using it
+	downloadedImages, err := p.downloadImages(images, plan)
+	if err != nil {
+		return fmt.Errorf("downloading talos images: %w", err)
 	}
 
 	// Create VMs
-	if err := p.createVMs(downloadedImage); err != nil {
+	if err := p.createVMs(plan, images, downloadedImages); err != nil {
 		return fmt.Errorf("creating VMs: %w", err)
 	}
 
 	return nil
 }
 
-// createVMs creates all the virtual machines
-func (p *Pipeline) createVMs(downloadedImage *download.File) error {
-	availableNodes, err := p.proxmox.GetAvailableNodes(p.ctx)
-	if err != nil {
-		return fmt.Errorf("getting available nodes: %w", err)
+// downloadImages downloads each distinct image to the hosts of the nodes using it,
+// returning the downloaded files keyed by image name and host.
+func (p *Pipeline) downloadImages(images map[string]*talos.Image, plan placement.Plan) (map[string]map[string]*download.File, error) {
+	var used []*talos.Image
+	hostsByImage := map[*talos.Image]placement.Plan{}
+	for _, node := range p.cluster.Nodes {
+		image := images[node.Pool().Schematic]
+		if hostsByImage[image] == nil {
+			hostsByImage[image] = placement.Plan{}
+			used = append(used, image)
+		}
+		hostsByImage[image][node.Name()] = plan[node.Name()]
 	}
 
-	for i, node := range p.cluster.Nodes {
-		p.ctx.Log.Info(fmt.Sprintf("Creating VM for node: %s", node.Name()), nil)
+	downloadedImages := map[string]map[string]*download.File{}
+	for _, image := range used {
+		imagePlan := hostsByImage[image]
+		imageConfig := proxmox.ImageConfig{
+			Name:        image.Name,
+			DatastoreID: p.config.ImageDatastore,
+			Shared:      p.config.ImageShared,
+			BootMode:    p.config.BootMode,
+		}
+		// Earlier versions downloaded the default image once, to the first online host
+		if image.Name == p.config.ClusterName && len(*p.proxmox.ComputeNodes) > 0 {
+			imageConfig.LegacyHost = (*p.proxmox.ComputeNodes)[0].Name()
+		}
+		files, err := p.proxmox.DownloadTalosImage(p.ctx, &image.Urls, imageConfig, imagePlan.Hosts())
+		if err != nil {
+			return nil, err
+		}
+		downloadedImages[image.Name] = files
+	}
 
+	return downloadedImages, nil
+}
+
+// createVMs creates all the virtual machines on their planned hosts. In ISO boot mode the VMs of the nodes
+// the previous deployment installed have an empty CD-ROM. The VM cannot depend on the configuration apply
+// that depends on its IP, so the ISO of a node installed by this run is ejected by detachISOs.
+func (p *Pipeline) createVMs(plan placement.Plan, images map[string]*talos.Image, downloadedImages map[string]map[string]*download.File) error {
+	var installed []string
+	if p.config.BootMode == types.BootModeISO {
+		if err := p.previousOutput(talos.InstalledNodesOutput, &installed); err != nil {
+			return err
+		}
+	}
+	isInstalled := map[string]bool{}
+	for _, name := range installed {
+		isInstalled[name] = true
+	}
+
+	p.isoAttached = map[string]*vm.VirtualMachine{}
+	for _, node := range p.cluster.Nodes {
+		node.SetHost(plan[node.Name()])
+		p.ctx.Log.Info(fmt.Sprintf("Creating VM for node %s on host %s", node.Name(), node.Host()), nil)
+
+		image := images[node.Pool().Schematic]
+		downloadedImage, ok := downloadedImages[image.Name][node.Host()]
+		if !ok {
+			return fmt.Errorf("talos image %s is not downloaded to host %s", image.Name, node.Host())
+		}
+
+		pool := node.Pool()
 		vmConfig := proxmox.VMConfig{
 			Name:          node.Name(),
-			NodeName:      availableNodes[i%len(availableNodes)],
-			Cores:         p.config.Cores,
-			MemoryMB:      p.config.Memory,
-			DiskSizeGB:    p.config.DiskSize,
-			NetworkBridge: p.config.Network,
-			CdromFileID:   downloadedImage.ID(),
+			NodeName:      node.Host(),
+			Cores:         pool.Cores,
+			MemoryMB:      pool.Memory,
+			DiskSizeGB:    pool.DiskSize,
+			NetworkBridge: pool.Bridge,
+			BootMode:      p.config.BootMode,
+			ImageFileID:   downloadedImage.ID(),
+			DetachCdrom:   isInstalled[node.Name()],
 			Provider:      p.proxmox.Provider,
 			DependsOn:     []pulumi.Resource{downloadedImage},
 		}
+		if p.config.Addressing != nil {
+			vmConfig.IPAddress = node.Address()
+			vmConfig.Gateway = p.config.Addressing.Gateway
+			vmConfig.DNSServers = p.config.Addressing.DNSServers
+		}
 
 		createdVM, ip, err := proxmox.CreateVM(p.ctx, vmConfig)
 		if err != nil {
@@ -153,24 +517,259 @@ func (p *Pipeline) createVMs(downloadedImage *download.File) error {
 
 		node.SetIP(ip)
 		node.SetVM(createdVM)
+		if p.config.BootMode == types.BootModeISO && !isInstalled[node.Name()] {
+			p.isoAttached[node.Name()] = createdVM
+		}
+	}
+
+	return nil
+}
+
+// placeVMs schedules every node's VM onto the online Proxmox hosts, spreading control planes across
+// separate hosts and keeping the VMs of the last deployment on their host.
+// Capacity is the hosts' total CPU and memory, not what is free right now, so that neither the load
+// nor this stack's own running VMs change the plan between runs.
+func (p *Pipeline) placeVMs() (placement.Plan, error) {
+	if p.proxmox.ComputeNodes == nil {
+		return nil, fmt.Errorf("proxmox hosts have not been gathered")
+	}
+
+	var hosts []placement.Host
+	for _, computeNode := range *p.proxmox.ComputeNodes {
+		hosts = append(hosts, placement.Host{
+			Name:     computeNode.Name(),
+			CPU:      int(float64(computeNode.CPU()) * p.config.CPUOvercommit),
+			MemoryMB: computeNode.Memory(),
+		})
+	}
+
+	var vms []placement.VM
+	for _, node := range p.cluster.Nodes {
+		vm := placement.VM{
+			Name:     node.Name(),
+			Cores:    node.Pool().Cores,
+			MemoryMB: node.Pool().Memory,
+		}
+		if node.Type() == types.ControlPlane {
+			vm.AntiAffinityGroup = types.ControlPlane.String()
+		}
+		vms = append(vms, vm)
+	}
+
+	var previous placement.Plan
+	if err := p.previousOutput(vmPlacementOutput, &previous); err != nil {
+		return nil, err
+	}
+	if previous == nil {
+		legacy, err := p.legacyPlacement(vms)
+		if err != nil {
+			return nil, err
+		}
+		previous = legacy
+	}
+
+	plan, err := placement.Schedule(hosts, vms, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, host := range previous {
+		if planned, ok := plan[name]; ok && planned != host {
+			p.ctx.Log.Warn(fmt.Sprintf("Host %s of node %s is unavailable, recreating its VM on %s", host, name, planned), nil)
+		}
+	}
+
+	p.ctx.Export(vmPlacementOutput, pulumi.ToStringMap(plan))
+	return plan, nil
+}
+
+// legacyPlacement returns the hosts of the VMs of a stack that an earlier version of this program deployed
+// without the VMPlacement output, so that no VM moves: the hosts the VMs are on, or the round-robin hosts
+// that version chose if the VMs cannot be listed. A stack that was never deployed has no placement.
+func (p *Pipeline) legacyPlacement(vms []placement.VM) (placement.Plan, error) {
+	var kubeconfig string
+	if err := p.previousOutput(talos.KubeconfigOutput, &kubeconfig); err != nil {
+		return nil, err
+	}
+	if kubeconfig == "" {
+		return nil, nil
+	}
+
+	names := make([]string, len(vms))
+	for i := range vms {
+		names[i] = vms[i].Name
+	}
+	existing, err := p.proxmox.VMHosts(p.ctx, names)
+	if err == nil {
+		return existing, nil
+	}
+
+	p.ctx.Log.Warn(fmt.Sprintf("Assuming the round-robin placement of earlier versions: %s", err), nil)
+	hosts, err := p.proxmox.GetAvailableNodes(p.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return placement.RoundRobin(vms, hosts), nil
+}
+
+// configureAPIEndpoint exports the control plane backends of the Kubernetes API endpoint for a load balancer.
+// The Talos VIP needs no setup besides the machine config.
+func (p *Pipeline) configureAPIEndpoint() error {
+	if p.config.APIEndpointMode == types.APIEndpointVIP {
+		return nil
 	}
 
+	backends := loadbalancer.Backends(p.cluster, p.config.APIServerPort)
+	p.ctx.Export("APIBackends", backends)
+	if p.config.APIEndpointMode == types.APIEndpointExternal {
+		p.ctx.Log.Info(fmt.Sprintf("Point the load balancer of %s at the APIBackends output", p.config.APIEndpoint()), nil)
+	}
+	return nil
+}
+
+// configureLoadBalancer renders the haproxy and keepalived configuration from the static control plane
+// addresses, so that a preview writes it before anything is deployed. The cluster only bootstraps
+// through a running load balancer, so the first update fails until the load balancer accepts connections.
+func (p *Pipeline) configureLoadBalancer() error {
+	if p.config.APIEndpointMode != types.APIEndpointHAProxy {
+		return nil
+	}
+
+	vip := ""
+	if p.config.VIP().IsValid() {
+		vip = p.config.VIP().String()
+	} else {
+		p.ctx.Log.Warn(fmt.Sprintf("apiVIP %s is not an IP, rendering no keepalived configuration", p.config.ApiVIP), nil)
+	}
+
+	backends, err := loadbalancer.StaticBackends(p.cluster, p.config.APIServerPort)
+	if err != nil {
+		return err
+	}
+	lb := p.config.LoadBalancer
+	files, err := loadbalancer.Render(lb, vip, p.config.APIPort(), backends)
+	if err != nil {
+		return fmt.Errorf("rendering load balancer configuration: %w", err)
+	}
+	p.ctx.Log.Info(fmt.Sprintf("Rendered load balancer configuration to %s, deploy it before the cluster bootstraps", lb.Dir), nil)
+	p.ctx.Export("LoadBalancerConfigs", pulumi.ToStringArray(files))
+
+	var bootstrapped string
+	if err := p.previousOutput(bootstrapNodeOutput, &bootstrapped); err != nil {
+		return err
+	}
+	if p.ctx.DryRun() || bootstrapped != "" {
+		return nil
+	}
+	address := net.JoinHostPort(p.config.APIHost(), p.config.APIPort())
+	if err := loadbalancer.CheckReachable(address); err != nil {
+		return fmt.Errorf("load balancer %s is not reachable, deploy the configuration in %s and run pulumi up again: %w", address, lb.Dir, err)
+	}
 	return nil
 }
 
 // deployTalos configures and bootstraps the Talos cluster
 func (p *Pipeline) deployTalos() error {
-	deployer := talos.NewDeployer(p.ctx, p.cluster, p.config)
-	return deployer.Deploy()
+	deployer := talos.NewDeployer(p.ctx, p.cluster, p.config, p.images)
+	running, err := p.runningKubernetesVersion()
+	if err != nil {
+		return err
+	}
+	if running != "" {
+		deployer.SetKubernetesVersion(running)
+	}
+	deployer.SetRetiredBootstrapNode(p.retiredBootstrap)
+
+	if err := deployer.Deploy(); err != nil {
+		return err
+	}
+
+	p.applied = deployer.Applied()
+	return nil
+}
+
+// runningKubernetesVersion returns the Kubernetes version of the last deployment, empty for a new cluster
+func (p *Pipeline) runningKubernetesVersion() (string, error) {
+	var running string
+	if err := p.previousOutput(talos.KubernetesVersionOutput, &running); err != nil {
+		return "", err
+	}
+	return running, nil
+}
+
+// upgradeCluster rolls a Talos version or schematic change out to the running nodes,
+// followed by a Kubernetes version change
+func (p *Pipeline) upgradeCluster() error {
+	var previous map[string]string
+	if err := p.previousOutput(talos.UpgradeOutput, &previous); err != nil {
+		return err
+	}
+
+	upgrader := talos.NewUpgrader(p.ctx, p.cluster, p.images, previous)
+	upgraded, err := upgrader.Rollout(p.applied)
+	if err != nil {
+		return fmt.Errorf("upgrading talos: %w", err)
+	}
+
+	running, err := p.runningKubernetesVersion()
+	if err != nil {
+		return err
+	}
+
+	applied := make([]pulumi.Resource, 0, len(p.applied))
+	for _, node := range p.cluster.Nodes {
+		if apply, ok := p.applied[node.Name()]; ok {
+			applied = append(applied, apply)
+		}
+	}
+
+	kubernetesUpgrader := talos.NewKubernetesUpgrader(p.ctx, p.cluster, running)
+	if err := kubernetesUpgrader.Upgrade(upgraded, applied); err != nil {
+		return fmt.Errorf("upgrading kubernetes: %w", err)
+	}
+	return nil
 }
 
 // generateOutputs creates the final outputs like kubeconfig
 func (p *Pipeline) generateOutputs() error {
-	if err := p.cluster.WaitForReady(p.ctx); err != nil {
-		return fmt.Errorf("waiting for cluster ready: %w", err)
+	if err := talos.GenerateKubeconfig(p.ctx, p.cluster); err != nil {
+		return fmt.Errorf("generating kubeconfig: %w", err)
+	}
+
+	if err := talos.GenerateTalosconfig(p.ctx, p.cluster, p.config.TalosconfigFile); err != nil {
+		return fmt.Errorf("generating talosconfig: %w", err)
 	}
 
+	p.health = p.cluster.WaitForReady(p.ctx)
+	p.ctx.Export("ClusterHealth", p.health)
 	p.ctx.Log.Info(fmt.Sprintf("Cluster %s is ready", p.cluster.Name), nil)
 
-	return talos.GenerateKubeconfig(p.ctx, p.cluster)
+	return nil
+}
+
+// detachISOs ejects the ISO from the nodes that boot it once their configuration is applied and the
+// cluster is healthy. Talos runs from memory, so the ISO is no longer needed, and the node boots from
+// its disk from then on.
+func (p *Pipeline) detachISOs() error {
+	if len(p.isoAttached) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, node := range p.cluster.Nodes {
+		isoVM, ok := p.isoAttached[node.Name()]
+		if !ok {
+			continue
+		}
+		apply, ok := p.applied[node.Name()]
+		if !ok {
+			return fmt.Errorf("configuration of node %s is not applied", node.Name())
+		}
+		if err := proxmox.DetachCdrom(p.ctx, p.creds, node.Name(), node.Host(), isoVM.VmId, p.health, []pulumi.Resource{apply}); err != nil {
+			return err
+		}
+		names = append(names, node.Name())
+	}
+	p.ctx.Log.Info(fmt.Sprintf("The Talos ISO is detached from nodes %s once the cluster is healthy", strings.Join(names, ", ")), nil)
+	return nil
 }
@@ -0,0 +1,45 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// previousOutput decodes an output of the last deployment of this stack into v.
+// It leaves v untouched if the stack has no such output yet.
+func (p *Pipeline) previousOutput(name string, v any) error {
+	if p.stackRef == nil {
+		self := fmt.Sprintf("%s/%s/%s", p.ctx.Organization(), p.ctx.Project(), p.ctx.Stack())
+		stackRef, err := pulumi.NewStackReference(p.ctx, "previous-state", &pulumi.StackReferenceArgs{
+			Name: pulumi.String(self),
+		})
+		if err != nil {
+			return fmt.Errorf("referencing stack %s: %w", self, err)
+		}
+		p.stackRef = stackRef
+	}
+
+	details, err := p.stackRef.GetOutputDetails(name)
+	if err != nil {
+		return fmt.Errorf("reading previous output %s: %w", name, err)
+	}
+
+	value := details.Value
+	if value == nil {
+		value = details.SecretValue
+	}
+	if value == nil {
+		return nil
+	}
+
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding previous output %s: %w", name, err)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("decoding previous output %s: %w", name, err)
+	}
+	return nil
+}
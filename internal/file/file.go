@@ -2,13 +2,19 @@
 package file
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 func WriteToFile(fileName, content string) error {
-	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0o644)
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
 	if err != nil {
 		return err
 	}
@@ -26,21 +32,100 @@ func WriteToFile(fileName, content string) error {
 	return nil
 }
 
-func GatherPatchFilesInDir(configDir string) ([]string, error) {
-	f, err := os.ReadDir(configDir)
-	if err != nil {
-		return nil, err
+// PatchRules filter patch files by glob. Patterns match the slash-separated path relative to the
+// config root or the file name; with Include set only matching files are used.
+type PatchRules struct {
+	Include []string
+	Exclude []string
+}
+
+// matches returns true if any pattern matches the relative path or its file name.
+func matches(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
 	}
+	return false
+}
 
-	var files []string
+// allows returns true if the rules keep the file at the relative path.
+func (r PatchRules) allows(rel string) bool {
+	if len(r.Include) > 0 && !matches(r.Include, rel) {
+		return false
+	}
+	return !matches(r.Exclude, rel)
+}
+
+// defaultPriority is the priority of patch files without a numeric prefix.
+const defaultPriority = 50
+
+// priorityPrefix matches the numeric priority prefix of a patch file name, e.g. "10-".
+var priorityPrefix = regexp.MustCompile(`^(\d+)[-_]`)
 
-	for _, file := range f {
-		if !strings.Contains(file.Name(), "yaml") {
+// priority returns the priority of a patch file from its numeric name prefix.
+func priority(name string) int {
+	if m := priorityPrefix.FindStringSubmatch(name); m != nil {
+		if p, err := strconv.Atoi(m[1]); err == nil {
+			return p
+		}
+	}
+	return defaultPriority
+}
+
+// isPatchFile returns true for YAML files and YAML templates.
+func isPatchFile(name string) bool {
+	for _, suffix := range []string{".yaml", ".yml", ".yaml.tmpl", ".yml.tmpl"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GatherPatchFiles returns the patch files of every layer below root, in layer order. Layers are
+// read recursively, missing layers are skipped, and files in a layer are ordered by their
+// priority prefix and then by path, so a file later in the list overrides the ones before it.
+func GatherPatchFiles(root string, layers []string, rules PatchRules) ([]string, error) {
+	var files []string
+	for _, layer := range layers {
+		dir := filepath.Join(root, layer)
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
 			continue
 		}
-		if !file.IsDir() {
-			files = append(files, fmt.Sprintf("%s/%s", configDir, file.Name()))
+
+		var layerFiles []string
+		err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !isPatchFile(d.Name()) {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if rules.allows(filepath.ToSlash(rel)) {
+				layerFiles = append(layerFiles, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading patch layer %s: %w", layer, err)
 		}
+
+		sort.SliceStable(layerFiles, func(i, j int) bool {
+			pi, pj := priority(filepath.Base(layerFiles[i])), priority(filepath.Base(layerFiles[j]))
+			if pi != pj {
+				return pi < pj
+			}
+			return layerFiles[i] < layerFiles[j]
+		})
+		files = append(files, layerFiles...)
 	}
 
 	return files, nil
@@ -0,0 +1,39 @@
+// Package identity keeps node names stable across deployments.
+package identity
+
+import (
+	"fmt"
+
+	"proxmox-talos/internal/types"
+)
+
+// DefaultName returns the name of the pool's node with the given index.
+func DefaultName(cluster string, pool *types.NodePool, index int) string {
+	return fmt.Sprintf("%s-%s-%d", cluster, pool.Name, index)
+}
+
+// Names returns the node names of a pool. Pinned names in the pool are used as they are.
+// Otherwise the names of the last deployment are kept in their order, the newest ones are
+// retired when the pool shrinks, and a growing pool gets the lowest free default names.
+func Names(cluster string, pool *types.NodePool, previous []string) []string {
+	if len(pool.Nodes) > 0 {
+		return append([]string(nil), pool.Nodes...)
+	}
+
+	names := append([]string(nil), previous...)
+	if len(names) >= pool.Count {
+		return names[:pool.Count]
+	}
+
+	taken := map[string]bool{}
+	for _, name := range names {
+		taken[name] = true
+	}
+	for i := 0; len(names) < pool.Count; i++ {
+		name := DefaultName(cluster, pool, i)
+		if !taken[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,103 @@
+// Package ipam hands out static node addresses from a configured range.
+package ipam
+
+import (
+	"fmt"
+	"net/netip"
+
+	"proxmox-talos/internal/types"
+)
+
+// Allocator assigns addresses from a network's allocation range to named nodes.
+type Allocator struct {
+	prefix    netip.Prefix
+	start     netip.Addr
+	end       netip.Addr
+	reserved  map[netip.Addr]bool
+	allocated map[string]netip.Addr
+	used      map[netip.Addr]string
+}
+
+// NewAllocator creates an allocator for the network. The gateway and DNS servers are never handed out.
+func NewAllocator(network *types.Network) (*Allocator, error) {
+	if err := network.Validate(); err != nil {
+		return nil, err
+	}
+
+	prefix, _ := network.Prefix()
+	a := &Allocator{
+		prefix:    prefix,
+		start:     netip.MustParseAddr(network.RangeStart),
+		end:       netip.MustParseAddr(network.RangeEnd),
+		reserved:  map[netip.Addr]bool{},
+		allocated: map[string]netip.Addr{},
+		used:      map[netip.Addr]string{},
+	}
+
+	a.Reserve(netip.MustParseAddr(network.Gateway))
+	for _, server := range network.DNSServers {
+		a.Reserve(netip.MustParseAddr(server))
+	}
+	return a, nil
+}
+
+// Reserve excludes an address from allocation.
+func (a *Allocator) Reserve(addr netip.Addr) {
+	a.reserved[addr] = true
+}
+
+// Restore re-assigns previously allocated addresses so that nodes keep their address between runs.
+// Addresses that are no longer inside the range, are reserved or already taken are dropped.
+func (a *Allocator) Restore(previous map[string]string) {
+	for name, address := range previous {
+		addr, err := netip.ParseAddr(address)
+		if err != nil || !a.inRange(addr) || a.reserved[addr] {
+			continue
+		}
+		if _, taken := a.used[addr]; taken {
+			continue
+		}
+		a.allocated[name] = addr
+		a.used[addr] = name
+	}
+}
+
+// Allocate returns the address of the named node, assigning the lowest free address in the range if it has none.
+func (a *Allocator) Allocate(name string) (netip.Addr, error) {
+	if addr, ok := a.allocated[name]; ok {
+		return addr, nil
+	}
+
+	for addr := a.start; a.inRange(addr); addr = addr.Next() {
+		if a.reserved[addr] {
+			continue
+		}
+		if _, taken := a.used[addr]; taken {
+			continue
+		}
+		a.allocated[name] = addr
+		a.used[addr] = name
+		return addr, nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("no free address left in %s-%s for node %s", a.start, a.end, name)
+}
+
+// Prefix returns addr with the subnet's prefix length, e.g. 192.168.4.10/24.
+func (a *Allocator) Prefix(addr netip.Addr) netip.Prefix {
+	return netip.PrefixFrom(addr, a.prefix.Bits())
+}
+
+// Allocations returns the addresses of every node allocated or restored so far.
+func (a *Allocator) Allocations() map[string]string {
+	allocations := make(map[string]string, len(a.allocated))
+	for name, addr := range a.allocated {
+		allocations[name] = addr.String()
+	}
+	return allocations
+}
+
+// inRange returns true if addr lies inside the allocation range.
+func (a *Allocator) inRange(addr netip.Addr) bool {
+	return addr.IsValid() && !addr.Less(a.start) && !a.end.Less(addr)
+}
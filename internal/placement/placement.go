@@ -0,0 +1,195 @@
+// Package placement decides which Proxmox host each VM is created on.
+package placement
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Host is a Proxmox host with the capacity available to VMs.
+type Host struct {
+	Name     string
+	CPU      int
+	MemoryMB int
+}
+
+// VM is a virtual machine that needs to be placed on a host.
+type VM struct {
+	Name     string
+	Cores    int
+	MemoryMB int
+	// AntiAffinityGroup places every VM of the same non-empty group on a separate host.
+	AntiAffinityGroup string
+}
+
+// Plan maps VM names to the name of the host they are placed on.
+type Plan map[string]string
+
+// CapacityError reports the VMs that could not be placed and the capacity left on every host.
+type CapacityError struct {
+	Unplaced []VM
+	Reasons  map[string]string
+	Hosts    []Host
+}
+
+// Error returns a report of the unplaced VMs and the remaining host capacity.
+func (e *CapacityError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d VM(s) do not fit on the available Proxmox hosts:\n", len(e.Unplaced))
+	for _, vm := range e.Unplaced {
+		fmt.Fprintf(&b, "  - %s (%d cores, %d MB): %s\n", vm.Name, vm.Cores, vm.MemoryMB, e.Reasons[vm.Name])
+	}
+	b.WriteString("remaining host capacity:\n")
+	for _, host := range e.Hosts {
+		fmt.Fprintf(&b, "  - %s: %d cores, %d MB\n", host.Name, host.CPU, host.MemoryMB)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// hostState tracks the remaining capacity and placed anti-affinity groups of a host.
+type hostState struct {
+	Host
+	groups map[string]bool
+}
+
+// Schedule bin-packs the VMs onto the hosts by remaining memory and CPU. VMs placed by the previous
+// plan stay on their host as long as it is available, since moving a VM replaces it; they take their
+// capacity and anti-affinity groups first. The remaining VMs with an anti-affinity group are placed
+// next, each on a host that holds no other member of the group, and then the rest in the order of vms.
+func Schedule(hosts []Host, vms []VM, previous Plan) (Plan, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts available for placement")
+	}
+
+	states := make([]*hostState, len(hosts))
+	byName := map[string]*hostState{}
+	for i, host := range hosts {
+		states[i] = &hostState{Host: host, groups: map[string]bool{}}
+		byName[host.Name] = states[i]
+	}
+
+	plan := Plan{}
+	var pending []VM
+	for _, vm := range vms {
+		if _, ok := plan[vm.Name]; ok {
+			return nil, fmt.Errorf("duplicate VM name %s", vm.Name)
+		}
+		host, ok := byName[previous[vm.Name]]
+		if !ok {
+			pending = append(pending, vm)
+			continue
+		}
+		// An existing VM keeps its host even if the host is overcommitted by now
+		host.place(vm)
+		plan[vm.Name] = host.Name
+	}
+
+	ordered := make([]VM, 0, len(pending))
+	for _, vm := range pending {
+		if vm.AntiAffinityGroup != "" {
+			ordered = append(ordered, vm)
+		}
+	}
+	for _, vm := range pending {
+		if vm.AntiAffinityGroup == "" {
+			ordered = append(ordered, vm)
+		}
+	}
+
+	capErr := &CapacityError{Reasons: map[string]string{}}
+	for _, vm := range ordered {
+		if _, ok := plan[vm.Name]; ok {
+			return nil, fmt.Errorf("duplicate VM name %s", vm.Name)
+		}
+
+		host, reason := bestFit(states, vm)
+		if host == nil {
+			capErr.Unplaced = append(capErr.Unplaced, vm)
+			capErr.Reasons[vm.Name] = reason
+			continue
+		}
+
+		host.place(vm)
+		plan[vm.Name] = host.Name
+	}
+
+	if len(capErr.Unplaced) > 0 {
+		for _, state := range states {
+			capErr.Hosts = append(capErr.Hosts, state.Host)
+		}
+		return nil, capErr
+	}
+
+	return plan, nil
+}
+
+// RoundRobin returns the placement of earlier versions of this program, which spread the VMs across
+// the hosts in order without regard to capacity or anti-affinity.
+func RoundRobin(vms []VM, hosts []string) Plan {
+	plan := Plan{}
+	if len(hosts) == 0 {
+		return plan
+	}
+	for i, vm := range vms {
+		plan[vm.Name] = hosts[i%len(hosts)]
+	}
+	return plan
+}
+
+// place takes the capacity and anti-affinity group of vm from the host.
+func (s *hostState) place(vm VM) {
+	s.CPU -= vm.Cores
+	s.MemoryMB -= vm.MemoryMB
+	if vm.AntiAffinityGroup != "" {
+		s.groups[vm.AntiAffinityGroup] = true
+	}
+}
+
+// bestFit returns the host that has the least memory left after placing vm, or a reason why no host fits.
+func bestFit(states []*hostState, vm VM) (*hostState, string) {
+	var candidates []*hostState
+	antiAffinityBlocked := false
+	for _, state := range states {
+		if vm.AntiAffinityGroup != "" && state.groups[vm.AntiAffinityGroup] {
+			antiAffinityBlocked = true
+			continue
+		}
+		if state.MemoryMB < vm.MemoryMB || state.CPU < vm.Cores {
+			continue
+		}
+		candidates = append(candidates, state)
+	}
+
+	if len(candidates) == 0 {
+		if antiAffinityBlocked {
+			return nil, fmt.Sprintf("no host without another %s VM has enough capacity", vm.AntiAffinityGroup)
+		}
+		return nil, "no host has enough memory and CPU left"
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].MemoryMB != candidates[j].MemoryMB {
+			return candidates[i].MemoryMB < candidates[j].MemoryMB
+		}
+		if candidates[i].CPU != candidates[j].CPU {
+			return candidates[i].CPU < candidates[j].CPU
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+	return candidates[0], ""
+}
+
+// Hosts returns the sorted, de-duplicated names of the hosts that receive at least one VM.
+func (p Plan) Hosts() []string {
+	seen := map[string]bool{}
+	var hosts []string
+	for _, host := range p {
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
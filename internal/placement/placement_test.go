@@ -0,0 +1,164 @@
+package placement
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchedule(t *testing.T) {
+	threeHosts := []Host{
+		{Name: "pve1", CPU: 16, MemoryMB: 32768},
+		{Name: "pve2", CPU: 16, MemoryMB: 32768},
+		{Name: "pve3", CPU: 16, MemoryMB: 16384},
+	}
+	controlPlanes := []VM{
+		{Name: "cp-1", Cores: 2, MemoryMB: 4096, AntiAffinityGroup: "controlplane"},
+		{Name: "cp-2", Cores: 2, MemoryMB: 4096, AntiAffinityGroup: "controlplane"},
+		{Name: "cp-3", Cores: 2, MemoryMB: 4096, AntiAffinityGroup: "controlplane"},
+	}
+
+	tests := []struct {
+		name     string
+		hosts    []Host
+		vms      []VM
+		previous Plan
+		want     Plan
+		err      string
+	}{
+		{
+			name:  "anti-affinity spreads control planes across hosts",
+			hosts: threeHosts,
+			vms:   controlPlanes,
+			want:  Plan{"cp-1": "pve3", "cp-2": "pve1", "cp-3": "pve2"},
+		},
+		{
+			name:  "anti-affinity needs a host per member",
+			hosts: threeHosts[:2],
+			vms:   controlPlanes,
+			err:   "cp-3 (2 cores, 4096 MB): no host without another controlplane VM has enough capacity",
+		},
+		{
+			name:  "VMs without a group pack onto the fullest host that fits",
+			hosts: threeHosts,
+			vms:   []VM{{Name: "worker-1", Cores: 4, MemoryMB: 8192}, {Name: "worker-2", Cores: 4, MemoryMB: 8192}},
+			want:  Plan{"worker-1": "pve3", "worker-2": "pve3"},
+		},
+		{
+			name:  "memory is a capacity limit",
+			hosts: threeHosts,
+			vms:   []VM{{Name: "worker-1", Cores: 4, MemoryMB: 65536}},
+			err:   "worker-1 (4 cores, 65536 MB): no host has enough memory and CPU left",
+		},
+		{
+			name:  "CPU is a capacity limit",
+			hosts: threeHosts,
+			vms:   []VM{{Name: "worker-1", Cores: 32, MemoryMB: 1024}},
+			err:   "worker-1 (32 cores, 1024 MB): no host has enough memory and CPU left",
+		},
+		{
+			name:     "VMs keep their previous host",
+			hosts:    threeHosts,
+			vms:      append(controlPlanes, VM{Name: "worker-1", Cores: 4, MemoryMB: 8192}),
+			previous: Plan{"cp-1": "pve1", "cp-2": "pve2", "cp-3": "pve3", "worker-1": "pve1"},
+			want:     Plan{"cp-1": "pve1", "cp-2": "pve2", "cp-3": "pve3", "worker-1": "pve1"},
+		},
+		{
+			name:     "previous hosts count against the capacity of new VMs",
+			hosts:    threeHosts,
+			vms:      []VM{{Name: "worker-1", Cores: 4, MemoryMB: 16384}, {Name: "worker-2", Cores: 4, MemoryMB: 8192}},
+			previous: Plan{"worker-1": "pve3"},
+			want:     Plan{"worker-1": "pve3", "worker-2": "pve1"},
+		},
+		{
+			name:     "a VM on a gone host is placed again",
+			hosts:    threeHosts[:2],
+			vms:      controlPlanes[:2],
+			previous: Plan{"cp-1": "pve3", "cp-2": "pve1"},
+			want:     Plan{"cp-1": "pve2", "cp-2": "pve1"},
+		},
+		{
+			name:  "duplicate VM names are rejected",
+			hosts: threeHosts,
+			vms:   []VM{{Name: "worker-1", Cores: 1, MemoryMB: 1024}, {Name: "worker-1", Cores: 1, MemoryMB: 1024}},
+			err:   "duplicate VM name worker-1",
+		},
+		{
+			name: "no hosts",
+			vms:  controlPlanes,
+			err:  "no hosts available for placement",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := Schedule(tt.hosts, tt.vms, tt.previous)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Schedule error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Schedule: %v", err)
+			}
+			if !reflect.DeepEqual(plan, tt.want) {
+				t.Errorf("Schedule = %v, want %v", plan, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleReportsRemainingCapacity(t *testing.T) {
+	hosts := []Host{{Name: "pve1", CPU: 4, MemoryMB: 8192}}
+	vms := []VM{{Name: "worker-1", Cores: 2, MemoryMB: 6144}, {Name: "worker-2", Cores: 2, MemoryMB: 6144}}
+
+	_, err := Schedule(hosts, vms, nil)
+	var capErr *CapacityError
+	if !errors.As(err, &capErr) {
+		t.Fatalf("Schedule error = %v, want a CapacityError", err)
+	}
+	if len(capErr.Unplaced) != 1 || capErr.Unplaced[0].Name != "worker-2" {
+		t.Errorf("unplaced VMs = %v, want worker-2", capErr.Unplaced)
+	}
+	if want := []Host{{Name: "pve1", CPU: 2, MemoryMB: 2048}}; !reflect.DeepEqual(capErr.Hosts, want) {
+		t.Errorf("remaining capacity = %v, want %v", capErr.Hosts, want)
+	}
+}
+
+func TestScheduleKeepsRoundRobinPlacement(t *testing.T) {
+	hosts := []Host{
+		{Name: "pve1", CPU: 8, MemoryMB: 8192},
+		{Name: "pve2", CPU: 64, MemoryMB: 262144},
+		{Name: "pve3", CPU: 8, MemoryMB: 8192},
+	}
+	vms := []VM{
+		{Name: "cp-1", Cores: 2, MemoryMB: 4096, AntiAffinityGroup: "controlplane"},
+		{Name: "cp-2", Cores: 2, MemoryMB: 4096, AntiAffinityGroup: "controlplane"},
+		{Name: "cp-3", Cores: 2, MemoryMB: 4096, AntiAffinityGroup: "controlplane"},
+		{Name: "worker-1", Cores: 4, MemoryMB: 8192},
+		{Name: "worker-2", Cores: 4, MemoryMB: 8192},
+	}
+
+	// Earlier versions placed worker-1 on pve1, which the scheduler would not pick, and overcommitted it
+	previous := RoundRobin(vms, []string{"pve1", "pve2", "pve3"})
+	want := Plan{"cp-1": "pve1", "cp-2": "pve2", "cp-3": "pve3", "worker-1": "pve1", "worker-2": "pve2"}
+	if !reflect.DeepEqual(previous, want) {
+		t.Fatalf("RoundRobin = %v, want %v", previous, want)
+	}
+
+	plan, err := Schedule(hosts, vms, previous)
+	if err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("Schedule = %v, want the round-robin placement %v", plan, want)
+	}
+}
+
+func TestRoundRobinWithoutHosts(t *testing.T) {
+	if plan := RoundRobin([]VM{{Name: "cp-1"}}, nil); len(plan) != 0 {
+		t.Errorf("RoundRobin without hosts = %v, want an empty plan", plan)
+	}
+}
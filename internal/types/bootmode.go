@@ -0,0 +1,25 @@
+package types
+
+import (
+	"fmt"
+)
+
+// BootMode selects how a VM receives Talos.
+type BootMode string
+
+const (
+	// BootModeISO boots the factory ISO from a CD-ROM and installs Talos to the VM disk.
+	BootModeISO BootMode = "iso"
+	// BootModeDisk imports the factory disk image as the VM boot disk.
+	BootModeDisk BootMode = "disk"
+)
+
+// Validate checks if the boot mode is known.
+func (b BootMode) Validate() error {
+	switch b {
+	case BootModeISO, BootModeDisk:
+		return nil
+	default:
+		return fmt.Errorf("boot mode must be %s or %s, got %q", BootModeISO, BootModeDisk, string(b))
+	}
+}
@@ -0,0 +1,44 @@
+package types
+
+import (
+	"fmt"
+)
+
+// CNIName selects the container network interface of the cluster.
+type CNIName string
+
+const (
+	// CNIFlannel keeps the Flannel CNI and kube-proxy that Talos deploys by default.
+	CNIFlannel CNIName = "flannel"
+	// CNICilium replaces Flannel and kube-proxy with Cilium, shipped as an inline manifest.
+	CNICilium CNIName = "cilium"
+	// CNINone deploys no CNI, leaving the cluster to be networked by other means.
+	CNINone CNIName = "none"
+)
+
+// DefaultCiliumVersion is the Cilium release installed when the cni section sets no version.
+const DefaultCiliumVersion = "1.17.6"
+
+// CNI describes the container network interface of the cluster.
+type CNI struct {
+	Name CNIName `json:"name"`
+	// Version is the release of the CNI's Helm chart.
+	Version string `json:"version,omitempty"`
+	// Values override the Helm values the chart is rendered with.
+	Values map[string]any `json:"values,omitempty"`
+}
+
+// Validate checks if the CNI is known and has a version if it is installed from a chart.
+func (c CNI) Validate() error {
+	switch c.Name {
+	case CNIFlannel, CNINone:
+		return nil
+	case CNICilium:
+		if c.Version == "" {
+			return fmt.Errorf("cni %s needs a version", c.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("cni must be %s, %s or %s, got %q", CNIFlannel, CNICilium, CNINone, string(c.Name))
+	}
+}
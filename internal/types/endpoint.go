@@ -0,0 +1,35 @@
+package types
+
+import (
+	"fmt"
+)
+
+// APIEndpointMode selects what serves the Kubernetes API endpoint in front of the control planes.
+type APIEndpointMode string
+
+const (
+	// APIEndpointVIP shares the endpoint IP between the control planes with Talos's layer-2 VIP.
+	APIEndpointVIP APIEndpointMode = "vip"
+	// APIEndpointHAProxy renders an HAProxy and keepalived configuration for a pair of load balancers.
+	APIEndpointHAProxy APIEndpointMode = "haproxy"
+	// APIEndpointExternal leaves the endpoint to an existing load balancer and only exports the backends.
+	APIEndpointExternal APIEndpointMode = "external"
+)
+
+// Validate checks if the API endpoint mode is known.
+func (m APIEndpointMode) Validate() error {
+	switch m {
+	case APIEndpointVIP, APIEndpointHAProxy, APIEndpointExternal:
+		return nil
+	default:
+		return fmt.Errorf("api endpoint mode must be %s, %s or %s, got %q", APIEndpointVIP, APIEndpointHAProxy, APIEndpointExternal, string(m))
+	}
+}
+
+// LoadBalancer configures the HAProxy load balancer pair of the haproxy API endpoint mode.
+type LoadBalancer struct {
+	// Dir receives the rendered haproxy.cfg and keepalived configurations.
+	Dir string `json:"dir"`
+	// Interface is the load balancer network interface keepalived announces the endpoint IP on.
+	Interface string `json:"interface"`
+}
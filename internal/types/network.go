@@ -0,0 +1,68 @@
+package types
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Network describes the static addressing of the node network.
+type Network struct {
+	// Bridge is the default Proxmox bridge for node pools that do not set their own.
+	Bridge     string   `json:"bridge,omitempty"`
+	CIDR       string   `json:"cidr"`
+	Gateway    string   `json:"gateway"`
+	DNSServers []string `json:"dnsServers"`
+	// RangeStart and RangeEnd bound the addresses handed out to nodes (inclusive).
+	RangeStart string `json:"rangeStart"`
+	RangeEnd   string `json:"rangeEnd"`
+}
+
+// Prefix returns the parsed node subnet.
+func (n *Network) Prefix() (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(n.CIDR)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network cidr %q: %w", n.CIDR, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// Validate checks that the gateway, DNS servers and allocation range are valid addresses of the subnet.
+func (n *Network) Validate() error {
+	prefix, err := n.Prefix()
+	if err != nil {
+		return err
+	}
+	if !prefix.Addr().Is4() {
+		return fmt.Errorf("network cidr %s must be an IPv4 subnet", n.CIDR)
+	}
+
+	gateway, err := netip.ParseAddr(n.Gateway)
+	if err != nil {
+		return fmt.Errorf("invalid network gateway %q: %w", n.Gateway, err)
+	}
+	if !prefix.Contains(gateway) {
+		return fmt.Errorf("network gateway %s is outside %s", gateway, prefix)
+	}
+
+	for _, server := range n.DNSServers {
+		if _, err := netip.ParseAddr(server); err != nil {
+			return fmt.Errorf("invalid DNS server %q: %w", server, err)
+		}
+	}
+
+	start, err := netip.ParseAddr(n.RangeStart)
+	if err != nil {
+		return fmt.Errorf("invalid network rangeStart %q: %w", n.RangeStart, err)
+	}
+	end, err := netip.ParseAddr(n.RangeEnd)
+	if err != nil {
+		return fmt.Errorf("invalid network rangeEnd %q: %w", n.RangeEnd, err)
+	}
+	if !prefix.Contains(start) || !prefix.Contains(end) {
+		return fmt.Errorf("network range %s-%s is outside %s", start, end, prefix)
+	}
+	if end.Less(start) {
+		return fmt.Errorf("network rangeEnd %s is before rangeStart %s", end, start)
+	}
+	return nil
+}
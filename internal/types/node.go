@@ -1,6 +1,8 @@
 package types
 
 import (
+	"fmt"
+
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
@@ -30,15 +32,29 @@ func (n NodeType) String() string {
 	}
 }
 
+// ParseNodeType returns the NodeType for its string representation.
+func ParseNodeType(s string) (NodeType, error) {
+	for _, n := range []NodeType{ControlPlane, Worker, Infrastructure, Other} {
+		if n.String() == s {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown node type %q", s)
+}
+
 // Node is the interface that all cluster nodes must implement.
 type Node interface {
 	Type() NodeType
-	Pool() string
-	SetPool(pool string)
+	Pool() *NodePool
+	SetPool(pool *NodePool)
 	Name() string
 	SetName(name string)
+	Host() string
+	SetHost(host string)
 	IP() pulumi.StringOutput
 	SetIP(ip pulumi.StringOutput)
+	Address() string
+	SetAddress(address string)
 	IsBootstrap() bool
 	SetBootstrap(isBootstrap bool)
 	Config() map[string]any
@@ -0,0 +1,101 @@
+package types
+
+import (
+	"fmt"
+)
+
+// Taint represents a Kubernetes taint applied to every node of a pool.
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Effect string `json:"effect"`
+}
+
+// Validate checks if the taint is well-formed.
+func (t Taint) Validate() error {
+	if t.Key == "" {
+		return fmt.Errorf("taint key is required")
+	}
+	switch t.Effect {
+	case "NoSchedule", "PreferNoSchedule", "NoExecute":
+	default:
+		return fmt.Errorf("taint %s has invalid effect %q", t.Key, t.Effect)
+	}
+	return nil
+}
+
+// String returns the taint in the "value:effect" form used by Talos nodeTaints.
+func (t Taint) String() string {
+	if t.Value == "" {
+		return t.Effect
+	}
+	return fmt.Sprintf("%s:%s", t.Value, t.Effect)
+}
+
+// NodePool describes a group of identically sized nodes sharing a role, labels and taints.
+type NodePool struct {
+	Name     string            `json:"name"`
+	Role     string            `json:"role"`
+	Count    int               `json:"count"`
+	Cores    int               `json:"cores"`
+	Memory   int               `json:"memory"`
+	DiskSize int               `json:"diskSize"`
+	Bridge   string            `json:"bridge"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Taints   []Taint           `json:"taints,omitempty"`
+	// Schematic names the image schematic of the pool, DefaultSchematic if empty.
+	Schematic string `json:"schematic,omitempty"`
+	// Nodes pins the names of the pool's nodes. Removing a name retires that node and a new name adds a fresh one.
+	Nodes []string `json:"nodes,omitempty"`
+}
+
+// String returns the name of the node pool.
+func (p *NodePool) String() string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+// Type returns the node type of the pool's role.
+func (p *NodePool) Type() (NodeType, error) {
+	return ParseNodeType(p.Role)
+}
+
+// Validate checks if the node pool has valid configuration.
+func (p *NodePool) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("node pool name is required")
+	}
+	nodeType, err := p.Type()
+	if err != nil {
+		return fmt.Errorf("node pool %s: %w", p.Name, err)
+	}
+	if nodeType != ControlPlane && nodeType != Worker {
+		return fmt.Errorf("node pool %s: role must be controlplane or worker, got %s", p.Name, p.Role)
+	}
+	if p.Count < 0 {
+		return fmt.Errorf("node pool %s: count must not be negative", p.Name)
+	}
+	if len(p.Nodes) > 0 && p.Count != len(p.Nodes) {
+		return fmt.Errorf("node pool %s: count %d does not match the %d pinned nodes", p.Name, p.Count, len(p.Nodes))
+	}
+	if p.Cores <= 0 {
+		return fmt.Errorf("node pool %s: cores must be > 0", p.Name)
+	}
+	if p.Memory <= 0 {
+		return fmt.Errorf("node pool %s: memory must be > 0", p.Name)
+	}
+	if p.DiskSize <= 0 {
+		return fmt.Errorf("node pool %s: diskSize must be > 0", p.Name)
+	}
+	if p.Bridge == "" {
+		return fmt.Errorf("node pool %s: bridge is required", p.Name)
+	}
+	for _, taint := range p.Taints {
+		if err := taint.Validate(); err != nil {
+			return fmt.Errorf("node pool %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
@@ -43,7 +43,7 @@ func (c *ComputeNode) SetCPU(cpu int) {
 	c.cpu = cpu
 }
 
-// Memory returns the memory (in MB) of the compute node.
+// Memory returns the total memory (in MB) of the compute node.
 func (c *ComputeNode) Memory() int {
 	return c.memory
 }
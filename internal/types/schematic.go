@@ -0,0 +1,54 @@
+package types
+
+import (
+	"fmt"
+)
+
+// DefaultSchematic is the name of the schematic used by node pools that do not set one.
+const DefaultSchematic = "default"
+
+// Schematic describes an image factory schematic: the extensions, kernel arguments,
+// overlay and META values baked into a Talos image.
+type Schematic struct {
+	Overlay       *Overlay `json:"overlay,omitempty" yaml:"overlay,omitempty"`
+	Customization struct {
+		ExtraKernelArgs  []string    `json:"extraKernelArgs,omitempty" yaml:"extraKernelArgs,omitempty"`
+		Meta             []MetaValue `json:"meta,omitempty" yaml:"meta,omitempty"`
+		SystemExtensions struct {
+			OfficialExtensions []string `json:"officialExtensions,omitempty" yaml:"officialExtensions,omitempty"`
+		} `json:"systemExtensions" yaml:"systemExtensions"`
+	} `json:"customization" yaml:"customization"`
+}
+
+// Overlay selects an image factory overlay, e.g. for single board computers.
+type Overlay struct {
+	Name    string         `json:"name" yaml:"name"`
+	Image   string         `json:"image" yaml:"image"`
+	Options map[string]any `json:"options,omitempty" yaml:"options,omitempty"`
+}
+
+// MetaValue is a value written to the Talos META partition.
+type MetaValue struct {
+	Key   uint8  `json:"key" yaml:"key"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// Validate checks if the schematic is well-formed.
+func (s *Schematic) Validate() error {
+	if s.Overlay != nil && (s.Overlay.Name == "" || s.Overlay.Image == "") {
+		return fmt.Errorf("overlay requires both name and image")
+	}
+	seen := map[uint8]bool{}
+	for _, meta := range s.Customization.Meta {
+		if seen[meta.Key] {
+			return fmt.Errorf("duplicate META key 0x%x", meta.Key)
+		}
+		seen[meta.Key] = true
+	}
+	for _, extension := range s.Customization.SystemExtensions.OfficialExtensions {
+		if extension == "" {
+			return fmt.Errorf("extension name must not be empty")
+		}
+	}
+	return nil
+}
@@ -23,7 +23,10 @@ type Cluster struct {
 	KubernetesAPI     string                         `json:"kubernetesAPI"`
 	MachineSecrets    *machine.Secrets               `json:"machineSecrets,omitempty"`
 	ClientConfig      *client.GetConfigurationResult `json:"clientConfig,omitempty"`
+	Bootstrap         *machine.Bootstrap             `json:"bootstrap,omitempty"`
 	Kubeconfig        pulumi.Output                  `json:"kubeconfig,omitempty"`
+	// ClientEndpoints are exported to talosctl as endpoints after the control plane IPs.
+	ClientEndpoints []string `json:"clientEndpoints,omitempty"`
 }
 
 // NewCluster creates a new Cluster instance.
@@ -36,9 +39,14 @@ func NewCluster(name, talosVersion, kubernetesVersion, kubernetesAPI string) *Cl
 	}
 }
 
-// GenerateNodes creates the specified number of nodes of the given type and adds them to the cluster.
-func (c *Cluster) GenerateNodes(amount int, nodeType types.NodeType) error {
-	for i := 0; i < amount; i++ {
+// GenerateNodes creates the named nodes of the given pool and adds them to the cluster.
+func (c *Cluster) GenerateNodes(pool *types.NodePool, names []string) error {
+	nodeType, err := pool.Type()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
 		var node types.Node
 		switch nodeType {
 		case types.ControlPlane:
@@ -53,8 +61,8 @@ func (c *Cluster) GenerateNodes(amount int, nodeType types.NodeType) error {
 			return errors.New("unknown node type")
 		}
 
-		node.SetName(fmt.Sprintf("%s-%s-%d", c.Name, nodeType.String(), i))
-		node.SetPool("default")
+		node.SetName(name)
+		node.SetPool(pool)
 		c.Nodes = append(c.Nodes, node)
 	}
 	return nil
@@ -71,6 +79,38 @@ func (c *Cluster) GetNodesByType(nodeType types.NodeType) []pulumi.StringOutput
 	return nodesOfType
 }
 
+// BootstrapNode returns the node that bootstraps etcd, or nil if there is none.
+func (c *Cluster) BootstrapNode() types.Node {
+	for _, node := range c.Nodes {
+		if node.IsBootstrap() {
+			return node
+		}
+	}
+	return nil
+}
+
+// SetBootstrapNode moves the bootstrap role to the named control plane.
+func (c *Cluster) SetBootstrapNode(name string) error {
+	var bootstrap types.Node
+	for _, node := range c.Nodes {
+		if node.Name() == name {
+			bootstrap = node
+		}
+	}
+	if bootstrap == nil {
+		return fmt.Errorf("node %s does not exist", name)
+	}
+	if bootstrap.Type() != types.ControlPlane {
+		return fmt.Errorf("node %s is not a control plane", name)
+	}
+
+	for _, node := range c.Nodes {
+		node.SetBootstrap(node == bootstrap)
+	}
+	c.HasBootstrapNode = true
+	return nil
+}
+
 // GenerateMachineSecrets creates Talos machine secrets for the cluster.
 func (c *Cluster) GenerateMachineSecrets(ctx *pulumi.Context) error {
 	machineSecrets, err := machine.NewSecrets(ctx, "talos-secrets", &machine.SecretsArgs{
@@ -104,15 +144,20 @@ func (c *Cluster) WaitForReady(ctx *pulumi.Context) pulumi.Output {
 
 	// Combine node IPs and MachineSecrets.ClientConfiguration Output
 	allOutputs := append(controlPlaneInputs, c.MachineSecrets.ClientConfiguration)
+	if c.Bootstrap != nil {
+		// Only check health once etcd has been bootstrapped
+		allOutputs = append([]interface{}{c.Bootstrap.ID()}, allOutputs...)
+	}
+	offset := len(allOutputs) - len(controlPlaneInputs) - 1
 	return pulumi.All(allOutputs...).ApplyT(func(args []interface{}) (string, error) {
 		var ipStrings []string
-		for i := 0; i < len(controlPlaneInputs); i++ {
+		for i := offset; i < offset+len(controlPlaneInputs); i++ {
 			if s, ok := args[i].(string); ok {
 				ipStrings = append(ipStrings, s)
 			}
 		}
-		clientConfig, ok := args[len(args)-1].(*machine.ClientConfiguration)
-		if !ok || clientConfig == nil {
+		clientConfig, ok := args[len(args)-1].(machine.ClientConfiguration)
+		if !ok {
 			_ = ctx.Log.Error("WaitForReady: MachineSecrets.ClientConfiguration is not set", nil)
 			return "MachineSecrets.ClientConfiguration is not set", errors.New("MachineSecrets.ClientConfiguration is not set")
 		}
@@ -123,7 +168,7 @@ func (c *Cluster) WaitForReady(ctx *pulumi.Context) pulumi.Output {
 				CaCertificate:     clientConfig.CaCertificate,
 			},
 			ControlPlaneNodes:    ipStrings,
-			Endpoints:            []string{c.KubernetesAPI},
+			Endpoints:            ipStrings,
 			SkipKubernetesChecks: nil,
 		}
 		_, err := cluster.GetHealth(ctx, healthArgs)
@@ -135,30 +180,6 @@ func (c *Cluster) WaitForReady(ctx *pulumi.Context) pulumi.Output {
 	})
 }
 
-func (c *Cluster) GenerateKubeconfig(ctx *pulumi.Context) error {
-	if c.ClientConfig == nil {
-		return errors.New("client configuration is not set")
-	}
-
-	args := &cluster.KubeconfigArgs{
-		ClientConfiguration: &cluster.KubeconfigClientConfigurationArgs{
-			ClientCertificate: c.MachineSecrets.ClientConfiguration.ClientCertificate(),
-			ClientKey:         c.MachineSecrets.ClientConfiguration.ClientKey(),
-			CaCertificate:     c.MachineSecrets.ClientConfiguration.CaCertificate(),
-		},
-		Node: c.Nodes[0].IP(),
-	}
-
-	fmt.Println(args)
-
-	k, err := cluster.NewKubeconfig(ctx, "talos-kubeconfig", args, pulumi.DependsOn([]pulumi.Resource{c.MachineSecrets}))
-	if err != nil {
-		return fmt.Errorf("failed to generate kubeconfig: %w", err)
-	}
-	ctx.Export("kubeconfig", k.KubeconfigRaw)
-	return nil
-}
-
 // String returns a string representation of the cluster.
 func (c *Cluster) String() string {
 	return fmt.Sprintf("Cluster{Name: %s, Nodes: %d, HasBootstrapNode: %t, TalosVersion: %s, KubernetesVersion: %s, KubernetesAPI: %s}",
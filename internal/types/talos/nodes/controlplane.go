@@ -10,8 +10,10 @@ type ControlPlaneNode struct {
 	name        string
 	isBootstrap bool
 	ip          pulumi.StringOutput
-	nodePool    string
+	address     string
+	nodePool    *types.NodePool
 	vm          pulumi.Resource
+	host        string
 }
 
 // SetBootstrap sets whether this node is the bootstrap node.
@@ -35,12 +37,12 @@ func (c *ControlPlaneNode) SetVM(vm pulumi.Resource) {
 }
 
 // SetPool sets the node pool for this node.
-func (c *ControlPlaneNode) SetPool(pool string) {
+func (c *ControlPlaneNode) SetPool(pool *types.NodePool) {
 	c.nodePool = pool
 }
 
 // Pool returns the node pool for this node.
-func (c *ControlPlaneNode) Pool() string {
+func (c *ControlPlaneNode) Pool() *types.NodePool {
 	return c.nodePool
 }
 
@@ -64,6 +66,16 @@ func (c *ControlPlaneNode) SetName(name string) {
 	c.name = name
 }
 
+// Host returns the name of the Proxmox host the node's VM is placed on.
+func (c *ControlPlaneNode) Host() string {
+	return c.host
+}
+
+// SetHost sets the name of the Proxmox host the node's VM is placed on.
+func (c *ControlPlaneNode) SetHost(host string) {
+	c.host = host
+}
+
 // IP returns the IP address of the node.
 func (c *ControlPlaneNode) IP() pulumi.StringOutput {
 	return c.ip
@@ -74,6 +86,16 @@ func (c *ControlPlaneNode) SetIP(ip pulumi.StringOutput) {
 	c.ip = ip
 }
 
+// Address returns the static address of the node in CIDR notation, or "" if it uses DHCP.
+func (c *ControlPlaneNode) Address() string {
+	return c.address
+}
+
+// SetAddress sets the static address of the node in CIDR notation.
+func (c *ControlPlaneNode) SetAddress(address string) {
+	c.address = address
+}
+
 // Config returns a map representation of the node's configuration.
 func (c *ControlPlaneNode) Config() map[string]any {
 	return map[string]any{
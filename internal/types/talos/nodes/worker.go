@@ -9,8 +9,10 @@ import (
 type WorkerNode struct {
 	name     string
 	ip       pulumi.StringOutput
-	nodePool string
+	address  string
+	nodePool *types.NodePool
 	vm       pulumi.Resource
+	host     string
 }
 
 // SetBootstrap is a no-op for worker nodes.
@@ -27,12 +29,12 @@ func (w *WorkerNode) SetVM(vm pulumi.Resource) {
 }
 
 // SetPool sets the node pool for this node.
-func (w *WorkerNode) SetPool(pool string) {
+func (w *WorkerNode) SetPool(pool *types.NodePool) {
 	w.nodePool = pool
 }
 
 // Pool returns the node pool for this node.
-func (w *WorkerNode) Pool() string {
+func (w *WorkerNode) Pool() *types.NodePool {
 	return w.nodePool
 }
 
@@ -56,6 +58,16 @@ func (w *WorkerNode) SetName(name string) {
 	w.name = name
 }
 
+// Host returns the name of the Proxmox host the node's VM is placed on.
+func (w *WorkerNode) Host() string {
+	return w.host
+}
+
+// SetHost sets the name of the Proxmox host the node's VM is placed on.
+func (w *WorkerNode) SetHost(host string) {
+	w.host = host
+}
+
 // IP returns the IP address of the node.
 func (w *WorkerNode) IP() pulumi.StringOutput {
 	return w.ip
@@ -71,12 +83,22 @@ func (w *WorkerNode) Type() types.NodeType {
 	return types.Worker
 }
 
+// Address returns the static address of the node in CIDR notation, or "" if it uses DHCP.
+func (w *WorkerNode) Address() string {
+	return w.address
+}
+
+// SetAddress sets the static address of the node in CIDR notation.
+func (w *WorkerNode) SetAddress(address string) {
+	w.address = address
+}
+
 // Config returns a map representation of the node's configuration.
 func (w *WorkerNode) Config() map[string]any {
 	return map[string]any{
 		"name":     w.name,
 		"ip":       w.ip,
-		"nodePool": w.nodePool,
+		"nodePool": w.nodePool.String(),
 		"nodeType": w.Type().String(),
 	}
 }
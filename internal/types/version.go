@@ -0,0 +1,103 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version as used by Talos and Kubernetes releases, e.g. v1.10.0.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// ParseVersion parses a version with or without the leading "v".
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) != 3 {
+		return Version{}, fmt.Errorf("version must have the form vMAJOR.MINOR.PATCH, got %q", s)
+	}
+
+	var numbers [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("version must have the form vMAJOR.MINOR.PATCH, got %q", s)
+		}
+		numbers[i] = n
+	}
+	return Version{Major: numbers[0], Minor: numbers[1], Patch: numbers[2]}, nil
+}
+
+// String returns the version with the leading "v".
+func (v Version) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or higher than other.
+func (v Version) Compare(other Version) int {
+	for _, d := range []int{v.Major - other.Major, v.Minor - other.Minor, v.Patch - other.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// kubernetesSupport maps a Talos minor release to the range of Kubernetes minor releases it supports.
+var kubernetesSupport = map[int][2]int{
+	5:  {23, 28},
+	6:  {24, 29},
+	7:  {25, 30},
+	8:  {26, 31},
+	9:  {27, 32},
+	10: {28, 33},
+	11: {29, 34},
+}
+
+// CheckKubernetesCompatibility checks that the Talos release supports the Kubernetes release.
+func CheckKubernetesCompatibility(talosVersion, kubernetesVersion string) error {
+	talos, err := ParseVersion(talosVersion)
+	if err != nil {
+		return fmt.Errorf("talos %w", err)
+	}
+	kubernetes, err := ParseVersion(kubernetesVersion)
+	if err != nil {
+		return fmt.Errorf("kubernetes %w", err)
+	}
+
+	supported, ok := kubernetesSupport[talos.Minor]
+	if talos.Major != 1 || !ok {
+		return fmt.Errorf("talos %s is not supported", talos)
+	}
+	if kubernetes.Major != 1 || kubernetes.Minor < supported[0] || kubernetes.Minor > supported[1] {
+		return fmt.Errorf("talos %s supports kubernetes v1.%d to v1.%d, got %s", talos, supported[0], supported[1], kubernetes)
+	}
+	return nil
+}
+
+// CheckKubernetesUpgrade checks that a cluster can be upgraded from one Kubernetes release to another.
+// Kubernetes only supports upgrades to the next minor release and no downgrades.
+func CheckKubernetesUpgrade(from, to string) error {
+	current, err := ParseVersion(from)
+	if err != nil {
+		return fmt.Errorf("running kubernetes %w", err)
+	}
+	target, err := ParseVersion(to)
+	if err != nil {
+		return fmt.Errorf("kubernetes %w", err)
+	}
+
+	if target.Compare(current) < 0 {
+		return fmt.Errorf("kubernetes cannot be downgraded from %s to %s", current, target)
+	}
+	if target.Major != current.Major || target.Minor > current.Minor+1 {
+		return fmt.Errorf("kubernetes can only be upgraded one minor release at a time, from %s to %s", current, target)
+	}
+	return nil
+}
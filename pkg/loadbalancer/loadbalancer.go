@@ -0,0 +1,158 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"proxmox-talos/internal/file"
+	"proxmox-talos/internal/types"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// haproxyConfig balances the Kubernetes API over every healthy control plane.
+var haproxyConfig = template.Must(template.New("haproxy.cfg").Parse(`global
+    log stdout format raw local0
+    maxconn 4096
+
+defaults
+    log global
+    mode tcp
+    option tcplog
+    timeout connect 5s
+    timeout client 1h
+    timeout server 1h
+
+frontend kubernetes-api
+    bind *:{{ .Port }}
+    default_backend control-planes
+
+backend control-planes
+    option httpchk GET /readyz
+    http-check expect status 200
+    default-server check check-ssl verify none inter 5s fall 3 rise 2
+{{- range $i, $backend := .Backends }}
+    server control-plane-{{ $i }} {{ $backend }}
+{{- end }}
+`))
+
+// keepalivedConfig moves the endpoint IP to the other load balancer when HAProxy fails.
+var keepalivedConfig = template.Must(template.New("keepalived.conf").Parse(`vrrp_script haproxy {
+    script "/usr/bin/killall -0 haproxy"
+    interval 2
+    fall 2
+    rise 2
+}
+
+vrrp_instance kubernetes-api {
+    state BACKUP
+    interface {{ .Interface }}
+    virtual_router_id 51
+    priority {{ .Priority }}
+    advert_int 1
+    nopreempt
+    virtual_ipaddress {
+        {{ .VIP }}
+    }
+    track_script {
+        haproxy
+    }
+}
+`))
+
+// Backends returns the Kubernetes API address of every control plane node, sorted, with the API server port.
+func Backends(c *talosCluster.Cluster, port int) pulumi.StringArrayOutput {
+	ips := c.GetNodesByType(types.ControlPlane)
+	inputs := make([]interface{}, len(ips))
+	for i, ip := range ips {
+		inputs[i] = ip
+	}
+
+	return pulumi.All(inputs...).ApplyT(func(args []interface{}) []string {
+		backends := make([]string, 0, len(args))
+		for _, arg := range args {
+			if ip, ok := arg.(string); ok && ip != "" {
+				backends = append(backends, net.JoinHostPort(ip, strconv.Itoa(port)))
+			}
+		}
+		sort.Strings(backends)
+		return backends
+	}).(pulumi.StringArrayOutput)
+}
+
+// StaticBackends returns the Kubernetes API address of every control plane node from its static address,
+// sorted, with the API server port. Unlike Backends they are known before the control planes exist.
+func StaticBackends(c *talosCluster.Cluster, port int) ([]string, error) {
+	var backends []string
+	for _, node := range c.Nodes {
+		if node.Type() != types.ControlPlane {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(node.Address())
+		if err != nil {
+			return nil, fmt.Errorf("control plane %s has no static address", node.Name())
+		}
+		backends = append(backends, net.JoinHostPort(prefix.Addr().String(), strconv.Itoa(port)))
+	}
+	sort.Strings(backends)
+	return backends, nil
+}
+
+// CheckReachable dials the load balancer at address and fails if nothing accepts the connection.
+func CheckReachable(address string) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Render writes haproxy.cfg and a keepalived configuration for each of the two load balancers to
+// lb.Dir. HAProxy listens on port and keepalived is skipped if vip is empty.
+func Render(lb types.LoadBalancer, vip, port string, backends []string) ([]string, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("no control plane backends")
+	}
+	if err := os.MkdirAll(lb.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating %s: %w", lb.Dir, err)
+	}
+
+	var written []string
+	write := func(name string, tmpl *template.Template, data any) error {
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, data); err != nil {
+			return fmt.Errorf("rendering %s: %w", name, err)
+		}
+		path := filepath.Join(lb.Dir, name)
+		if err := file.WriteToFile(path, out.String()); err != nil {
+			return fmt.Errorf("writing %s: %w", path, err)
+		}
+		written = append(written, path)
+		return nil
+	}
+
+	if err := write("haproxy.cfg", haproxyConfig, map[string]any{"Port": port, "Backends": backends}); err != nil {
+		return nil, err
+	}
+	if vip == "" {
+		return written, nil
+	}
+
+	// Both peers start as backup so that a recovered load balancer does not take the IP back
+	for i, priority := range []int{101, 100} {
+		name := fmt.Sprintf("keepalived-%d.conf", i+1)
+		data := map[string]any{"Interface": lb.Interface, "Priority": priority, "VIP": vip}
+		if err := write(name, keepalivedConfig, data); err != nil {
+			return nil, err
+		}
+	}
+	return written, nil
+}
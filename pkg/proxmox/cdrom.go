@@ -0,0 +1,60 @@
+package proxmox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// detachCdromScript ejects the ISO from the CD-ROM of VM $PVE_VMID on host $PVE_NODE through the
+// Proxmox API. The token secret or password is read from stdin and passed to curl through stdin as
+// well, so it never touches a command line.
+const detachCdromScript = `set -eu
+secret=$(cat)
+api="$PVE_ENDPOINT/api2/json"
+set -- --fail --silent --show-error
+if [ -n "$PVE_CA_BUNDLE" ]; then set -- "$@" --cacert "$PVE_CA_BUNDLE"; fi
+if [ "$PVE_INSECURE" = true ]; then set -- "$@" --insecure; fi
+if [ -n "$PVE_TOKEN_ID" ]; then
+	headers="Authorization: PVEAPIToken=$PVE_TOKEN_ID=$secret"
+else
+	ticket=$(printf '%s' "$secret" | curl "$@" --data-urlencode "username=$PVE_USERNAME" --data-urlencode "password@-" "$api/access/ticket")
+	headers="Cookie: PVEAuthCookie=$(printf '%s' "$ticket" | sed -n 's/.*"ticket":"\([^"]*\)".*/\1/p')
+CSRFPreventionToken: $(printf '%s' "$ticket" | sed -n 's/.*"CSRFPreventionToken":"\([^"]*\)".*/\1/p')"
+fi
+printf '%s\n' "$headers" | curl "$@" --request PUT --header @- --data-urlencode "ide3=none,media=cdrom" "$api/nodes/$PVE_NODE/qemu/$PVE_VMID/config" >/dev/null`
+
+// DetachCdrom ejects the ISO from the CD-ROM of a VM once after resolves and the resources in
+// dependsOn are created. It runs once, when the command is created; the next deployment declares
+// the CD-ROM empty on the VM itself, see VMConfig.DetachCdrom, and deletes the command without
+// touching the VM again. The command needs curl.
+func DetachCdrom(ctx *pulumi.Context, creds *Credentials, name, host string, vmID pulumi.IntOutput, after pulumi.Input, dependsOn []pulumi.Resource) error {
+	environment := pulumi.StringMap{
+		"PVE_ENDPOINT":  pulumi.String(strings.TrimSuffix(creds.Endpoint, "/")),
+		"PVE_NODE":      pulumi.String(host),
+		"PVE_VMID":      vmID.ApplyT(strconv.Itoa).(pulumi.StringOutput),
+		"PVE_CA_BUNDLE": pulumi.String(creds.CABundle),
+		"PVE_INSECURE":  pulumi.String(strconv.FormatBool(creds.Insecure)),
+		"PVE_TOKEN_ID":  pulumi.String(creds.TokenID),
+		"PVE_USERNAME":  pulumi.String(creds.Username),
+	}
+	secret := creds.Password
+	if creds.UsesToken() {
+		secret = creds.TokenSecret
+	}
+
+	_, err := local.NewCommand(ctx, fmt.Sprintf("%s-detach-cdrom", name), &local.CommandArgs{
+		Create:      pulumi.String(detachCdromScript),
+		Environment: environment,
+		Stdin:       pulumi.ToSecret(pulumi.String(secret)).(pulumi.StringOutput),
+		// Only a known after lets the command run
+		Triggers: pulumi.Array{after},
+	}, pulumi.DependsOn(dependsOn))
+	if err != nil {
+		return fmt.Errorf("failed to detach the CD-ROM of VM %s: %w", name, err)
+	}
+	return nil
+}
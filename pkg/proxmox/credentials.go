@@ -0,0 +1,158 @@
+package proxmox
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+)
+
+// SSHConfig holds the optional SSH settings the provider uses for operations the API does not cover.
+type SSHConfig struct {
+	Username   string
+	Password   string
+	PrivateKey string
+	Agent      bool
+}
+
+// Credentials holds the endpoint, authentication and TLS settings for the Proxmox API.
+type Credentials struct {
+	Endpoint string
+	// Username and Password authenticate with a ticket.
+	Username string
+	Password string
+	// TokenID (user@realm!tokenid) and TokenSecret authenticate with an API token.
+	TokenID     string
+	TokenSecret string
+	// CABundle is the path to a PEM file with the CAs that sign the API certificate. The provider only
+	// trusts the system roots, so pulumi must run with SSL_CERT_FILE holding the bundle, see VerifyTLS.
+	CABundle string
+	// Insecure disables TLS verification entirely.
+	Insecure bool
+	// VerifyPrivileges checks the credentials' privileges before any resource is created.
+	VerifyPrivileges bool
+	SSH              *SSHConfig
+}
+
+// LoadCredentials reads the Proxmox credentials from the stack configuration.
+func LoadCredentials(conf *config.Config) (*Credentials, error) {
+	creds := &Credentials{
+		Endpoint:         conf.Require("PROXMOX_HOST"),
+		Username:         conf.Get("PROXMOX_USERNAME"),
+		Password:         conf.Get("PROXMOX_PASSWORD"),
+		TokenID:          conf.Get("PROXMOX_API_TOKEN_ID"),
+		TokenSecret:      conf.Get("PROXMOX_API_TOKEN_SECRET"),
+		CABundle:         conf.Get("PROXMOX_CA_BUNDLE"),
+		Insecure:         conf.GetBool("PROXMOX_INSECURE"),
+		VerifyPrivileges: true,
+	}
+
+	// The provider verifies certificates against CAs only, it cannot enforce a pinned fingerprint
+	if conf.Get("PROXMOX_TLS_FINGERPRINT") != "" {
+		return nil, fmt.Errorf("PROXMOX_TLS_FINGERPRINT cannot be enforced by the Proxmox provider, set PROXMOX_CA_BUNDLE to the CA that signs the API certificate, e.g. /etc/pve/pve-root-ca.pem")
+	}
+
+	if verify, err := conf.TryBool("PROXMOX_VERIFY_PRIVILEGES"); err == nil {
+		creds.VerifyPrivileges = verify
+	}
+
+	sshUsername := conf.Get("PROXMOX_SSH_USERNAME")
+	sshPassword := conf.Get("PROXMOX_SSH_PASSWORD")
+	sshPrivateKey := conf.Get("PROXMOX_SSH_PRIVATE_KEY")
+	sshAgent := conf.GetBool("PROXMOX_SSH_AGENT")
+	if sshUsername != "" || sshPassword != "" || sshPrivateKey != "" || sshAgent {
+		creds.SSH = &SSHConfig{
+			Username:   sshUsername,
+			Password:   sshPassword,
+			PrivateKey: sshPrivateKey,
+			Agent:      sshAgent,
+		}
+	}
+
+	if err := creds.Validate(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// Validate checks that exactly one authentication method is set and that TLS verification is not both customized and disabled.
+func (c *Credentials) Validate() error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("PROXMOX_HOST is required")
+	}
+
+	useToken := c.TokenID != "" || c.TokenSecret != ""
+	usePassword := c.Username != "" || c.Password != ""
+	switch {
+	case useToken && usePassword:
+		return fmt.Errorf("set either PROXMOX_API_TOKEN_ID/PROXMOX_API_TOKEN_SECRET or PROXMOX_USERNAME/PROXMOX_PASSWORD, not both")
+	case useToken:
+		if c.TokenID == "" || c.TokenSecret == "" {
+			return fmt.Errorf("PROXMOX_API_TOKEN_ID and PROXMOX_API_TOKEN_SECRET must be set together")
+		}
+		if !strings.Contains(c.TokenID, "@") || !strings.Contains(c.TokenID, "!") {
+			return fmt.Errorf("PROXMOX_API_TOKEN_ID must have the form user@realm!tokenid, got %q", c.TokenID)
+		}
+	case usePassword:
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("PROXMOX_USERNAME and PROXMOX_PASSWORD must be set together")
+		}
+	default:
+		return fmt.Errorf("no Proxmox credentials configured: set PROXMOX_API_TOKEN_ID/PROXMOX_API_TOKEN_SECRET or PROXMOX_USERNAME/PROXMOX_PASSWORD")
+	}
+
+	if c.CABundle != "" && c.Insecure {
+		return fmt.Errorf("PROXMOX_CA_BUNDLE and PROXMOX_INSECURE are mutually exclusive")
+	}
+
+	if c.SSH != nil && c.SSH.Username == "" && c.Username == "" {
+		return fmt.Errorf("PROXMOX_SSH_USERNAME is required when authenticating with an API token")
+	}
+	return nil
+}
+
+// UsesToken returns true if the credentials authenticate with an API token.
+func (c *Credentials) UsesToken() bool {
+	return c.TokenID != ""
+}
+
+// APIToken returns the token in the user@realm!tokenid=secret form expected by the provider.
+func (c *Credentials) APIToken() string {
+	return fmt.Sprintf("%s=%s", c.TokenID, c.TokenSecret)
+}
+
+// providerArgs converts the credentials into provider arguments, keeping every secret a Pulumi secret.
+func (c *Credentials) providerArgs() *proxmoxve.ProviderArgs {
+	args := &proxmoxve.ProviderArgs{
+		Endpoint: pulumi.String(c.Endpoint),
+		// A custom CA reaches the provider through SSL_CERT_FILE, which VerifyTLS checks first
+		Insecure: pulumi.Bool(c.Insecure),
+	}
+
+	if c.UsesToken() {
+		args.ApiToken = pulumi.ToSecret(pulumi.String(c.APIToken())).(pulumi.StringOutput)
+	} else {
+		args.Username = pulumi.String(c.Username)
+		args.Password = pulumi.ToSecret(pulumi.String(c.Password)).(pulumi.StringOutput)
+	}
+
+	if c.SSH != nil {
+		ssh := &proxmoxve.ProviderSshArgs{
+			Agent: pulumi.Bool(c.SSH.Agent),
+		}
+		if c.SSH.Username != "" {
+			ssh.Username = pulumi.String(c.SSH.Username)
+		}
+		if c.SSH.Password != "" {
+			ssh.Password = pulumi.ToSecret(pulumi.String(c.SSH.Password)).(pulumi.StringOutput)
+		}
+		if c.SSH.PrivateKey != "" {
+			ssh.PrivateKey = pulumi.ToSecret(pulumi.String(c.SSH.PrivateKey)).(pulumi.StringOutput)
+		}
+		args.Ssh = ssh
+	}
+
+	return args
+}
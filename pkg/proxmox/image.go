@@ -2,31 +2,144 @@ package proxmox
 
 import (
 	"fmt"
+	"strings"
+
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/download"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/imagefactory"
+	"proxmox-talos/internal/types"
 )
 
-// DownloadTalosImage downloads the Talos ISO image to the first available compute node.
-func (p *Proxmox) DownloadTalosImage(ctx *pulumi.Context, factoryOutput *imagefactory.GetUrlsResultOutput) (*download.File, error) {
-	if p.ComputeNodes == nil || len(*p.ComputeNodes) == 0 {
+// ImageConfig describes which Talos image is downloaded and where to.
+type ImageConfig struct {
+	// Name is the base name of the downloaded file and of its Pulumi resource.
+	Name string
+	// DatastoreID is the Proxmox datastore that holds the image.
+	DatastoreID string
+	// Shared is true if the datastore is visible to every host (NFS, CephFS, ...),
+	// in which case the image is downloaded only once.
+	Shared bool
+	// BootMode selects the factory ISO or the factory disk image.
+	BootMode types.BootMode
+	// LegacyHost is the host of the single "talos-image" download of earlier versions of this program.
+	// The download to that host, or the shared download, adopts it instead of replacing it.
+	LegacyHost string
+}
+
+// legacyImageResource is the name of the single image download of earlier versions of this program.
+const legacyImageResource = "talos-image"
+
+// Validate checks the ImageConfig for required fields.
+func (cfg *ImageConfig) Validate() error {
+	if cfg.Name == "" {
+		return fmt.Errorf("ImageConfig: Name is required")
+	}
+	if cfg.DatastoreID == "" {
+		return fmt.Errorf("ImageConfig: DatastoreID is required")
+	}
+	if err := cfg.BootMode.Validate(); err != nil {
+		return fmt.Errorf("ImageConfig: %w", err)
+	}
+	return nil
+}
+
+// extension returns the file extension of the downloaded image.
+// Proxmox only accepts .iso and .img in iso datastores, so disk images are stored as .img.
+func (cfg *ImageConfig) extension() string {
+	if cfg.BootMode == types.BootModeDisk {
+		return "img"
+	}
+	return "iso"
+}
+
+// diskImageSource returns the URL of a compressed disk image and the algorithm Proxmox decompresses it with.
+// Proxmox cannot decompress xz, so xz images are fetched as zstd, which the image factory also serves.
+func diskImageSource(url string) (string, string) {
+	switch {
+	case strings.HasSuffix(url, ".raw.xz"):
+		return strings.TrimSuffix(url, ".xz") + ".zst", "zst"
+	case strings.HasSuffix(url, ".zst"):
+		return url, "zst"
+	case strings.HasSuffix(url, ".gz"):
+		return url, "gz"
+	case strings.HasSuffix(url, ".bz2"):
+		return url, "bz2"
+	default:
+		return url, ""
+	}
+}
+
+// DownloadTalosImage downloads the Talos image so that it is available on each of the given hosts.
+// It returns the downloaded file for every host; hosts sharing a datastore share the same file.
+func (p *Proxmox) DownloadTalosImage(ctx *pulumi.Context, factoryOutput *imagefactory.GetUrlsResultOutput, cfg ImageConfig, hosts []string) (map[string]*download.File, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
 		return nil, fmt.Errorf("no compute nodes available to download the image")
 	}
 
-	nodeName := (*p.ComputeNodes)[0].Name()
+	url := factoryOutput.Urls().Iso()
+	var decompression pulumi.StringPtrInput
+	if cfg.BootMode == types.BootModeDisk {
+		url = factoryOutput.Urls().DiskImage().ApplyT(func(u string) string {
+			source, _ := diskImageSource(u)
+			return source
+		}).(pulumi.StringOutput)
+		decompression = factoryOutput.Urls().DiskImage().ApplyT(func(u string) *string {
+			_, algorithm := diskImageSource(u)
+			if algorithm == "" {
+				return nil
+			}
+			return &algorithm
+		}).(pulumi.StringPtrOutput)
+	}
+
+	images := make(map[string]*download.File, len(hosts))
+	for _, host := range hosts {
+		if _, ok := images[host]; ok {
+			continue
+		}
+
+		resourceName := fmt.Sprintf("%s-image-%s", cfg.Name, host)
+		fileName := fmt.Sprintf("%s-%s.%s", cfg.Name, host, cfg.extension())
+		if cfg.Shared {
+			resourceName = fmt.Sprintf("%s-image-%s", cfg.Name, cfg.DatastoreID)
+			fileName = fmt.Sprintf("%s.%s", cfg.Name, cfg.extension())
+		}
 
-	downloadedImage, err := download.NewFile(ctx, "talos-image", &download.FileArgs{
-		Url:         factoryOutput.Urls().Iso(),
-		ContentType: pulumi.String("iso"),
-		FileName:    pulumi.String(fmt.Sprintf("talos-%s.iso", nodeName)),
-		DatastoreId: pulumi.String("local"),
-		NodeName:    pulumi.String(nodeName),
-		Overwrite:   pulumi.Bool(true),
-	}, pulumi.Provider(p.Provider))
+		opts := []pulumi.ResourceOption{pulumi.Provider(p.Provider)}
+		if cfg.LegacyHost != "" && (cfg.Shared || host == cfg.LegacyHost) {
+			opts = append(opts, pulumi.Aliases([]pulumi.Alias{{Name: pulumi.String(legacyImageResource)}}))
+		}
+		if cfg.Shared {
+			// Every host sees the shared datastore, so the host it was downloaded through does not matter
+			// and a placement change must not replace the image
+			opts = append(opts, pulumi.IgnoreChanges([]string{"nodeName"}))
+		}
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to download Talos image: %w", err)
+		downloadedImage, err := download.NewFile(ctx, resourceName, &download.FileArgs{
+			Url:                    url,
+			ContentType:            pulumi.String("iso"),
+			FileName:               pulumi.String(fileName),
+			DatastoreId:            pulumi.String(cfg.DatastoreID),
+			NodeName:               pulumi.String(host),
+			DecompressionAlgorithm: decompression,
+			Overwrite:              pulumi.Bool(true),
+		}, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download Talos image to %s: %w", host, err)
+		}
+		ctx.Log.Info(fmt.Sprintf("Downloading Talos image %s to datastore %s on node %s", fileName, cfg.DatastoreID, host), nil)
+
+		if cfg.Shared {
+			for _, h := range hosts {
+				images[h] = downloadedImage
+			}
+			break
+		}
+		images[host] = downloadedImage
 	}
-	ctx.Log.Info(fmt.Sprintf("Downloaded Talos image to %s on node %s", downloadedImage.FileName, nodeName), nil)
-	return downloadedImage, nil
+
+	return images, nil
 }
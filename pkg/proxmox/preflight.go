@@ -0,0 +1,305 @@
+package proxmox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// preflightTimeout bounds every request made by the preflight check.
+const preflightTimeout = 30 * time.Second
+
+// Requirements lists the Proxmox objects the deployment touches.
+type Requirements struct {
+	// Datastores that receive VM disks.
+	DiskDatastores []string
+	// Datastores that receive downloaded images.
+	ImageDatastores []string
+	// Bridges the VMs are attached to.
+	Bridges []string
+	// CloudInit is set if the VMs receive their static address through cloud-init.
+	CloudInit bool
+}
+
+// requiredPrivileges maps every ACL path the deployment needs to the privileges required on it.
+func (r Requirements) requiredPrivileges() map[string][]string {
+	privileges := map[string][]string{
+		// Listing the nodes and downloading images from a URL
+		"/": {"Sys.Audit", "Sys.Modify"},
+		"/vms": {
+			"VM.Allocate",
+			"VM.Audit",
+			"VM.Config.CDROM",
+			"VM.Config.CPU",
+			"VM.Config.Disk",
+			"VM.Config.HWType",
+			"VM.Config.Memory",
+			"VM.Config.Network",
+			"VM.Config.Options",
+			"VM.PowerMgmt",
+		},
+	}
+	if r.CloudInit {
+		privileges["/vms"] = appendMissing(privileges["/vms"], "VM.Config.Cloudinit")
+	}
+	for _, datastore := range r.DiskDatastores {
+		path := "/storage/" + datastore
+		privileges[path] = appendMissing(privileges[path], "Datastore.AllocateSpace", "Datastore.Audit")
+	}
+	for _, datastore := range r.ImageDatastores {
+		path := "/storage/" + datastore
+		privileges[path] = appendMissing(privileges[path], "Datastore.AllocateTemplate", "Datastore.Audit")
+	}
+	for _, bridge := range r.Bridges {
+		path := "/sdn/zones/localnetwork/" + bridge
+		privileges[path] = appendMissing(privileges[path], "SDN.Use")
+	}
+	return privileges
+}
+
+// appendMissing appends the values not yet contained in s.
+func appendMissing(s []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range s {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// VerifyTLS checks the API certificate against the configured CA bundle and that the provider will
+// trust the bundle too. The provider only trusts the system roots, which Go reads from SSL_CERT_FILE on
+// Linux, so pulumi must run with SSL_CERT_FILE pointing at a file holding every CA of the bundle.
+func VerifyTLS(ctx *pulumi.Context, creds *Credentials) error {
+	if creds.CABundle == "" {
+		return nil
+	}
+
+	client, err := creds.httpClient()
+	if err != nil {
+		return err
+	}
+
+	// Any response proves the handshake verified the certificate, the version needs no privileges
+	resp, err := client.Get(creds.apiURL("/version"))
+	if err != nil {
+		return fmt.Errorf("verifying the Proxmox API certificate: %w", err)
+	}
+	resp.Body.Close()
+
+	if err := checkProviderTrust(creds.CABundle); err != nil {
+		return err
+	}
+
+	ctx.Log.Info("Proxmox API certificate is signed by PROXMOX_CA_BUNDLE, which the provider trusts", nil)
+	return nil
+}
+
+// checkProviderTrust fails unless SSL_CERT_FILE, which the provider inherits from pulumi, holds every
+// certificate of bundle.
+func checkProviderTrust(bundle string) error {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		return fmt.Errorf("the Proxmox provider ignores SSL_CERT_FILE on %s, trust the CA in the system store and unset PROXMOX_CA_BUNDLE", runtime.GOOS)
+	}
+
+	trusted := os.Getenv("SSL_CERT_FILE")
+	if trusted == "" {
+		return fmt.Errorf("the Proxmox provider only trusts the system roots, run pulumi with SSL_CERT_FILE=%s", bundle)
+	}
+
+	want, err := readCertificates(bundle)
+	if err != nil {
+		return fmt.Errorf("reading PROXMOX_CA_BUNDLE: %w", err)
+	}
+	have, err := readCertificates(trusted)
+	if err != nil {
+		return fmt.Errorf("reading SSL_CERT_FILE: %w", err)
+	}
+	for cert := range want {
+		if !have[cert] {
+			return fmt.Errorf("SSL_CERT_FILE %s lacks a CA of PROXMOX_CA_BUNDLE %s, the provider would not trust the API certificate", trusted, bundle)
+		}
+	}
+	return nil
+}
+
+// readCertificates returns the DER encoding of every PEM certificate in path.
+func readCertificates(path string) (map[string]bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := map[string]bool{}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			certs[string(block.Bytes)] = true
+		}
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s contains no PEM certificates", path)
+	}
+	return certs, nil
+}
+
+// VerifyAccess checks that the credentials hold every privilege the deployment needs.
+func VerifyAccess(ctx *pulumi.Context, creds *Credentials, req Requirements) error {
+	client, err := creds.httpClient()
+	if err != nil {
+		return err
+	}
+
+	authorize, err := creds.authorizer(client)
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	privileges := req.requiredPrivileges()
+	paths := make([]string, 0, len(privileges))
+	for path := range privileges {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		granted, err := creds.permissions(client, authorize, path)
+		if err != nil {
+			return err
+		}
+		for _, privilege := range privileges[path] {
+			if granted[privilege] == 0 {
+				missing = append(missing, fmt.Sprintf("%s on %s", privilege, path))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Proxmox credentials are missing privileges:\n  - %s", strings.Join(missing, "\n  - "))
+	}
+
+	ctx.Log.Info("Proxmox credentials hold all required privileges", nil)
+	return nil
+}
+
+// httpClient returns an HTTP client that verifies the API certificate the way the credentials ask for.
+func (c *Credentials) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch {
+	case c.CABundle != "":
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXMOX_CA_BUNDLE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("PROXMOX_CA_BUNDLE %s contains no PEM certificates", c.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	case c.Insecure:
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return &http.Client{
+		Timeout:   preflightTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// apiURL returns the URL of an API path below the configured endpoint.
+func (c *Credentials) apiURL(path string) string {
+	return strings.TrimSuffix(c.Endpoint, "/") + "/api2/json" + path
+}
+
+// authorizer returns a function that authenticates a request with the configured credentials.
+func (c *Credentials) authorizer(client *http.Client) (func(*http.Request), error) {
+	if c.UsesToken() {
+		header := "PVEAPIToken=" + c.APIToken()
+		return func(r *http.Request) {
+			r.Header.Set("Authorization", header)
+		}, nil
+	}
+
+	form := url.Values{"username": {c.Username}, "password": {c.Password}}
+	resp, err := client.PostForm(c.apiURL("/access/ticket"), form)
+	if err != nil {
+		return nil, fmt.Errorf("authenticating with Proxmox: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var ticket struct {
+		Data struct {
+			Ticket string `json:"ticket"`
+		} `json:"data"`
+	}
+	if err := decodeResponse(resp, &ticket); err != nil {
+		return nil, fmt.Errorf("authenticating with Proxmox: %w", err)
+	}
+	if ticket.Data.Ticket == "" {
+		return nil, fmt.Errorf("authenticating with Proxmox: invalid username or password")
+	}
+
+	return func(r *http.Request) {
+		r.AddCookie(&http.Cookie{Name: "PVEAuthCookie", Value: ticket.Data.Ticket})
+	}, nil
+}
+
+// permissions returns the effective privileges of the credentials on path.
+func (c *Credentials) permissions(client *http.Client, authorize func(*http.Request), path string) (map[string]int, error) {
+	req, err := http.NewRequest(http.MethodGet, c.apiURL("/access/permissions?path="+url.QueryEscape(path)), nil)
+	if err != nil {
+		return nil, err
+	}
+	authorize(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading Proxmox permissions on %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	var permissions struct {
+		Data map[string]map[string]int `json:"data"`
+	}
+	if err := decodeResponse(resp, &permissions); err != nil {
+		return nil, fmt.Errorf("reading Proxmox permissions on %s: %w", path, err)
+	}
+	return permissions.Data[path], nil
+}
+
+// decodeResponse decodes a JSON API response or returns an error for a non-2xx status.
+func decodeResponse(resp *http.Response, v any) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
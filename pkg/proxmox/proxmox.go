@@ -5,28 +5,21 @@ import (
 
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve"
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/cluster"
+	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/vm"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
-	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 	"proxmox-talos/internal/types/proxmox"
 )
 
+// bytesPerMB converts the memory reported by the Proxmox API (bytes) to MB.
+const bytesPerMB = 1024 * 1024
+
 // Proxmox is a wrapper around the internal Proxmox type for Pulumi integration.
 type Proxmox proxmox.Proxmox
 type VirtualMachine proxmox.VirtualMachine
 
-// NewProxmox initializes a new Proxmox instance with the provided configuration.
-func NewProxmox(ctx *pulumi.Context, conf *config.Config) (*Proxmox, error) {
-	proxmoxUsername := conf.Require("PROXMOX_USERNAME")
-	password := conf.RequireSecret("PROXMOX_PASSWORD")
-	proxmoxHost := conf.Require("PROXMOX_HOST")
-
-	proxmoxProvider, err := proxmoxve.NewProvider(ctx, "proxmoxve", &proxmoxve.ProviderArgs{
-		Endpoint: pulumi.String(proxmoxHost),
-		Username: pulumi.String(proxmoxUsername),
-		Password: password,
-		Insecure: pulumi.Bool(true),
-	})
-
+// NewProxmox initializes a new Proxmox instance with the provided credentials.
+func NewProxmox(ctx *pulumi.Context, creds *Credentials) (*Proxmox, error) {
+	proxmoxProvider, err := proxmoxve.NewProvider(ctx, "proxmoxve", creds.providerArgs())
 	if err != nil {
 		return nil, ctx.Log.Error("Creating Proxmox Provider failed with: "+err.Error(), nil)
 	}
@@ -67,7 +60,8 @@ func (p *Proxmox) GatherHosts(ctx *pulumi.Context) error {
 		newNode := proxmox.ComputeNode{}
 		newNode.SetName(node)
 		newNode.SetCPU(availableNodes.CpuCounts[i])
-		newNode.SetMemory(availableNodes.MemoryAvailables[i])
+		// MemoryAvailables is the host's total memory (maxmem), matching the total CPU count
+		newNode.SetMemory(availableNodes.MemoryAvailables[i] / bytesPerMB)
 
 		if err := newNode.Validate(); err != nil {
 			return fmt.Errorf("invalid compute node %s: %w", node, err)
@@ -78,3 +72,54 @@ func (p *Proxmox) GatherHosts(ctx *pulumi.Context) error {
 
 	return nil
 }
+
+// VMHosts returns the host of every VM named in names. A name held by VMs on several hosts is left out,
+// since those VMs cannot be told apart.
+func (p *Proxmox) VMHosts(ctx *pulumi.Context, names []string) (map[string]string, error) {
+	result, err := vm.GetVirtualMachines(ctx, &vm.GetVirtualMachinesArgs{}, pulumi.Provider(p.Provider))
+	if err != nil {
+		return nil, fmt.Errorf("listing Proxmox VMs: %w", err)
+	}
+
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	hosts := map[string]string{}
+	ambiguous := map[string]bool{}
+	for _, machine := range result.Vms {
+		if !wanted[machine.Name] || machine.Template != nil && *machine.Template {
+			continue
+		}
+		if host, ok := hosts[machine.Name]; ok && host != machine.NodeName {
+			ambiguous[machine.Name] = true
+		}
+		hosts[machine.Name] = machine.NodeName
+	}
+	for name := range ambiguous {
+		ctx.Log.Warn(fmt.Sprintf("VMs named %s exist on several hosts, leaving the placement of node %s to the scheduler", name, name), nil)
+		delete(hosts, name)
+	}
+	return hosts, nil
+}
+
+// GetAvailableNodes returns the names of the online compute nodes gathered by GatherHosts.
+func (p *Proxmox) GetAvailableNodes(ctx *pulumi.Context) ([]string, error) {
+	if p.ComputeNodes == nil {
+		if err := p.GatherHosts(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(*p.ComputeNodes))
+	for _, node := range *p.ComputeNodes {
+		names = append(names, node.Name())
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no online Proxmox nodes found")
+	}
+
+	return names, nil
+}
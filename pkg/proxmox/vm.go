@@ -2,14 +2,19 @@ package proxmox
 
 import (
 	"fmt"
+	"net/netip"
 
 	"github.com/muhlba91/pulumi-proxmoxve/sdk/v7/go/proxmoxve/vm"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"proxmox-talos/internal/types"
 )
 
 // We do this to fix a weird issue with the Proxmox provider where it always updates the VM disk speed settings
 var magicNumber = 9999999
 
+// DiskDatastore is the datastore that holds the VM boot disks.
+const DiskDatastore = "local"
+
 // VMConfig holds the configuration for creating a Proxmox VM.
 type VMConfig struct {
 	Name          string
@@ -18,9 +23,19 @@ type VMConfig struct {
 	MemoryMB      int
 	DiskSizeGB    int
 	NetworkBridge string
-	CdromFileID   pulumi.IDOutput
-	Provider      pulumi.ProviderResource
-	DependsOn     []pulumi.Resource
+	// BootMode selects whether ImageFileID is attached as CD-ROM or imported as boot disk.
+	BootMode    types.BootMode
+	ImageFileID pulumi.IDOutput
+	// DetachCdrom declares the CD-ROM empty once Talos is installed to disk. The install is only known
+	// from the previous deployment; the deployment of the install ejects the ISO with DetachCdrom.
+	DetachCdrom bool
+	// IPAddress is the static address in CIDR notation handed to the VM through cloud-init.
+	// The VM uses DHCP if it is empty.
+	IPAddress  string
+	Gateway    string
+	DNSServers []string
+	Provider   pulumi.ProviderResource
+	DependsOn  []pulumi.Resource
 }
 
 // Validate checks the VMConfig for required fields and returns an error if any are missing or invalid.
@@ -43,9 +58,20 @@ func (cfg *VMConfig) Validate() error {
 	if cfg.NetworkBridge == "" {
 		return fmt.Errorf("VMConfig: NetworkBridge is required")
 	}
+	if err := cfg.BootMode.Validate(); err != nil {
+		return fmt.Errorf("VMConfig: %w", err)
+	}
 	if cfg.Provider == nil {
 		return fmt.Errorf("VMConfig: Provider is required")
 	}
+	if cfg.IPAddress != "" {
+		if _, err := netip.ParsePrefix(cfg.IPAddress); err != nil {
+			return fmt.Errorf("VMConfig: IPAddress must be in CIDR notation: %w", err)
+		}
+		if cfg.Gateway == "" {
+			return fmt.Errorf("VMConfig: Gateway is required with IPAddress")
+		}
+	}
 	return nil
 }
 
@@ -55,6 +81,40 @@ func CreateVM(ctx *pulumi.Context, cfg VMConfig) (*vm.VirtualMachine, pulumi.Str
 		return nil, pulumi.String("").ToStringOutput(), fmt.Errorf("invalid VMConfig: %w", err)
 	}
 
+	bootDisk := &vm.VirtualMachineDiskArgs{
+		Interface:   pulumi.String("virtio0"),
+		Size:        pulumi.Int(cfg.DiskSizeGB),
+		DatastoreId: pulumi.String(DiskDatastore),
+		Speed: &vm.VirtualMachineDiskSpeedArgs{
+			IopsRead:           pulumi.Int(magicNumber),
+			IopsReadBurstable:  pulumi.Int(magicNumber),
+			IopsWrite:          pulumi.Int(magicNumber),
+			IopsWriteBurstable: pulumi.Int(magicNumber),
+			Read:               pulumi.Int(magicNumber),
+			ReadBurstable:      pulumi.Int(magicNumber),
+			Write:              pulumi.Int(magicNumber),
+			WriteBurstable:     pulumi.Int(magicNumber),
+		},
+	}
+	bootOrders := pulumi.StringArray{pulumi.String("virtio0")}
+	var cdrom *vm.VirtualMachineCdromArgs
+
+	switch {
+	case cfg.BootMode == types.BootModeDisk:
+		// Talos is already installed on the imported image, so the VM boots straight from it
+		bootDisk.FileId = cfg.ImageFileID
+	case cfg.DetachCdrom:
+		cdrom = &vm.VirtualMachineCdromArgs{
+			FileId: pulumi.String("none"),
+		}
+	default:
+		// The empty disk falls through to the ISO until Talos is installed
+		bootOrders = append(bootOrders, pulumi.String("ide3"))
+		cdrom = &vm.VirtualMachineCdromArgs{
+			FileId: cfg.ImageFileID,
+		}
+	}
+
 	vmArgs := &vm.VirtualMachineArgs{
 		NodeName: pulumi.String(cfg.NodeName),
 		Name:     pulumi.String(cfg.Name),
@@ -72,23 +132,9 @@ func CreateVM(ctx *pulumi.Context, cfg VMConfig) (*vm.VirtualMachine, pulumi.Str
 			Dedicated: pulumi.Int(cfg.MemoryMB),
 		},
 		Disks: &vm.VirtualMachineDiskArray{
-			&vm.VirtualMachineDiskArgs{
-				Interface:   pulumi.String("virtio0"),
-				Size:        pulumi.Int(cfg.DiskSizeGB),
-				DatastoreId: pulumi.String("local"),
-				Speed: &vm.VirtualMachineDiskSpeedArgs{
-					IopsRead:           pulumi.Int(magicNumber),
-					IopsReadBurstable:  pulumi.Int(magicNumber),
-					IopsWrite:          pulumi.Int(magicNumber),
-					IopsWriteBurstable: pulumi.Int(magicNumber),
-					Read:               pulumi.Int(magicNumber),
-					ReadBurstable:      pulumi.Int(magicNumber),
-					Write:              pulumi.Int(magicNumber),
-					WriteBurstable:     pulumi.Int(magicNumber),
-				},
-			},
+			bootDisk,
 		},
-		BootOrders:    pulumi.StringArray{pulumi.String("virtio0"), pulumi.String("ide3")},
+		BootOrders:    bootOrders,
 		StopOnDestroy: pulumi.Bool(true),
 		OperatingSystem: &vm.VirtualMachineOperatingSystemArgs{
 			Type: pulumi.String("l26"),
@@ -98,9 +144,26 @@ func CreateVM(ctx *pulumi.Context, cfg VMConfig) (*vm.VirtualMachine, pulumi.Str
 				Bridge: pulumi.String(cfg.NetworkBridge),
 			},
 		},
-		Cdrom: &vm.VirtualMachineCdromArgs{
-			FileId: cfg.CdromFileID,
-		},
+	}
+	if cdrom != nil {
+		vmArgs.Cdrom = cdrom
+	}
+
+	if cfg.IPAddress != "" {
+		vmArgs.Initialization = &vm.VirtualMachineInitializationArgs{
+			DatastoreId: pulumi.String(DiskDatastore),
+			IpConfigs: vm.VirtualMachineInitializationIpConfigArray{
+				&vm.VirtualMachineInitializationIpConfigArgs{
+					Ipv4: &vm.VirtualMachineInitializationIpConfigIpv4Args{
+						Address: pulumi.String(cfg.IPAddress),
+						Gateway: pulumi.String(cfg.Gateway),
+					},
+				},
+			},
+			Dns: &vm.VirtualMachineInitializationDnsArgs{
+				Servers: pulumi.ToStringArray(cfg.DNSServers),
+			},
+		}
 	}
 
 	opts := []pulumi.ResourceOption{
@@ -109,6 +172,10 @@ func CreateVM(ctx *pulumi.Context, cfg VMConfig) (*vm.VirtualMachine, pulumi.Str
 	if len(cfg.DependsOn) > 0 {
 		opts = append(opts, pulumi.DependsOn(cfg.DependsOn))
 	}
+	if cfg.BootMode == types.BootModeDisk {
+		// A new image is rolled out by a Talos upgrade, not by recreating the VM from it
+		opts = append(opts, pulumi.IgnoreChanges([]string{"disks[0].fileId"}))
+	}
 
 	createdVM, err := vm.NewVirtualMachine(ctx, cfg.Name, vmArgs, opts...)
 	if err != nil {
@@ -116,6 +183,10 @@ func CreateVM(ctx *pulumi.Context, cfg VMConfig) (*vm.VirtualMachine, pulumi.Str
 	}
 
 	ip := createdVM.Ipv4Addresses.ApplyT(func(ipv4 [][]string) string {
+		// Static addresses are known up front, the guest agent report only signals that the VM is up
+		if cfg.IPAddress != "" {
+			return netip.MustParsePrefix(cfg.IPAddress).Addr().String()
+		}
 		if len(ipv4) == 0 {
 			return ""
 		}
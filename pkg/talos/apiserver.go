@@ -0,0 +1,29 @@
+package talos
+
+import (
+	"encoding/json"
+)
+
+// defaultAPIServerPort is the port Talos runs the Kubernetes API server on unless configured otherwise.
+const defaultAPIServerPort = 6443
+
+// APIServerPortPatch represents the port of the Kubernetes API server on a control plane.
+type APIServerPortPatch struct {
+	Cluster struct {
+		ControlPlane struct {
+			LocalAPIServerPort int `json:"localAPIServerPort"`
+		} `json:"controlPlane"`
+	} `json:"cluster"`
+}
+
+// NewAPIServerPortPatch creates a JSON patch that makes the Kubernetes API server listen on port.
+// It returns nil for the default port.
+func NewAPIServerPortPatch(port int) ([]byte, error) {
+	if port == defaultAPIServerPort {
+		return nil, nil
+	}
+
+	patch := APIServerPortPatch{}
+	patch.Cluster.ControlPlane.LocalAPIServerPort = port
+	return json.Marshal(patch)
+}
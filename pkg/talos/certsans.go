@@ -0,0 +1,25 @@
+package talos
+
+import (
+	"encoding/json"
+)
+
+// CertSANsPatch represents the extra subject alternative names of the Talos and Kubernetes API certificates.
+type CertSANsPatch struct {
+	Machine struct {
+		CertSANs []string `json:"certSANs"`
+	} `json:"machine"`
+	Cluster struct {
+		APIServer struct {
+			CertSANs []string `json:"certSANs"`
+		} `json:"apiServer"`
+	} `json:"cluster"`
+}
+
+// NewCertSANsPatch creates a JSON patch that adds sans to the Talos API and Kubernetes API server certificates.
+func NewCertSANsPatch(sans []string) ([]byte, error) {
+	patch := CertSANsPatch{}
+	patch.Machine.CertSANs = sans
+	patch.Cluster.APIServer.CertSANs = sans
+	return json.Marshal(patch)
+}
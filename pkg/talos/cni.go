@@ -0,0 +1,175 @@
+package talos
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"proxmox-talos/internal/file"
+	"proxmox-talos/internal/types"
+)
+
+// kubePrismPort is the port of the Talos KubePrism API server load balancer on every node.
+const kubePrismPort = 7445
+
+// ciliumRepo is the Helm repository of the Cilium chart.
+const ciliumRepo = "https://helm.cilium.io"
+
+// renderCiliumScript renders the Cilium chart with the values read from stdin.
+const renderCiliumScript = `helm template cilium cilium --repo "$REPO" --version "${VERSION#v}" --namespace kube-system --values -`
+
+// chartsDir holds the rendered charts below configDir, one file per chart version and values.
+const chartsDir = "charts"
+
+// ciliumValues are the Helm values Cilium needs on Talos: kube-proxy replacement reaching the API
+// server through KubePrism, the capabilities Talos allows and the cgroup v2 mount Talos provides.
+var ciliumValues = map[string]any{
+	"ipam":                 map[string]any{"mode": "kubernetes"},
+	"kubeProxyReplacement": true,
+	"k8sServiceHost":       "localhost",
+	"k8sServicePort":       kubePrismPort,
+	"securityContext": map[string]any{
+		"capabilities": map[string]any{
+			"ciliumAgent":      []any{"CHOWN", "KILL", "NET_ADMIN", "NET_RAW", "IPC_LOCK", "SYS_ADMIN", "SYS_RESOURCE", "DAC_OVERRIDE", "FOWNER", "SETGID", "SETUID"},
+			"cleanCiliumState": []any{"NET_ADMIN", "SYS_ADMIN", "SYS_RESOURCE"},
+		},
+	},
+	"cgroup": map[string]any{
+		"autoMount": map[string]any{"enabled": false},
+		"hostRoot":  "/sys/fs/cgroup",
+	},
+	// Certificates generated by Helm would change the manifest, and with it every control plane's config, on each run
+	"hubble": map[string]any{
+		"tls": map[string]any{"auto": map[string]any{"method": "cronJob"}},
+	},
+}
+
+// CNIPatch represents the replacement of the default Flannel CNI and kube-proxy.
+type CNIPatch struct {
+	Machine struct {
+		Features struct {
+			KubePrism struct {
+				Enabled bool `json:"enabled"`
+				Port    int  `json:"port"`
+			} `json:"kubePrism"`
+		} `json:"features"`
+	} `json:"machine"`
+	Cluster struct {
+		Network struct {
+			CNI struct {
+				Name string `json:"name"`
+			} `json:"cni"`
+		} `json:"network"`
+		Proxy struct {
+			Disabled bool `json:"disabled"`
+		} `json:"proxy"`
+	} `json:"cluster"`
+}
+
+// NewCNIPatch creates a JSON patch that disables the default CNI, and kube-proxy for a CNI replacing it.
+// It returns nil for Flannel, which Talos deploys by default.
+func NewCNIPatch(cni types.CNI) ([]byte, error) {
+	if cni.Name == types.CNIFlannel {
+		return nil, nil
+	}
+
+	patch := CNIPatch{}
+	patch.Cluster.Network.CNI.Name = "none"
+	if cni.Name == types.CNICilium {
+		patch.Cluster.Proxy.Disabled = true
+		patch.Machine.Features.KubePrism.Enabled = true
+		patch.Machine.Features.KubePrism.Port = kubePrismPort
+	}
+	return json.Marshal(patch)
+}
+
+// CNIManifests returns the inline manifests installing the CNI, none for Flannel and no CNI.
+// The Cilium chart is rendered once with helm, see renderChart.
+func CNIManifests(ctx *pulumi.Context, cni types.CNI) ([]InlineManifest, error) {
+	if cni.Name != types.CNICilium {
+		return nil, nil
+	}
+
+	values, err := json.Marshal(mergeValues(ciliumValues, cni.Values))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cilium values: %w", err)
+	}
+
+	path := chartPath("cilium", ciliumRepo, cni.Version, values)
+	manifest, rendered, err := renderChart(path, renderCiliumScript, ciliumRepo, cni.Version, values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render the cilium chart: %w", err)
+	}
+	if rendered {
+		ctx.Log.Info(fmt.Sprintf("Rendered the cilium chart to %s, commit it to keep previews offline", path), nil)
+	}
+
+	return []InlineManifest{{Name: "cilium", Contents: pulumi.String(manifest)}}, nil
+}
+
+// chartPath returns the file in chartsDir that holds a chart rendered at version with values.
+// The name carries a digest of the repository and values, so changing either renders the chart again.
+func chartPath(name, repo, version string, values []byte) string {
+	digest := sha256.Sum256([]byte(repo + "\n" + version + "\n" + string(values)))
+	file := fmt.Sprintf("%s-%s-%s.yaml", name, strings.TrimPrefix(version, "v"), hex.EncodeToString(digest[:])[:12])
+	return filepath.Join(configDir, chartsDir, file)
+}
+
+// renderChart returns the chart rendered to path. If path does not exist yet, the chart is rendered
+// with script, which runs helm and needs access to repo, and written to path.
+// Every later preview and update reads the file, so the manifest only changes with the chart version
+// or values. rendered is true if helm ran.
+func renderChart(path, script, repo, version string, values []byte) (manifest string, rendered bool, err error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		return string(content), false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "REPO="+repo, "VERSION="+version)
+	cmd.Stdin = bytes.NewReader(values)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", false, fmt.Errorf("helm failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", false, fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := file.WriteToFile(path, string(out)); err != nil {
+		return "", false, fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return string(out), true, nil
+}
+
+// mergeValues merges Helm values: maps are merged recursively and any other value of src replaces dst's.
+func mergeValues(dst, src map[string]any) map[string]any {
+	merged := make(map[string]any, len(dst)+len(src))
+	for k, v := range dst {
+		merged[k] = v
+	}
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]any)
+		dstMap, dstIsMap := merged[k].(map[string]any)
+		if srcIsMap && dstIsMap {
+			merged[k] = mergeValues(dstMap, srcMap)
+			continue
+		}
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,60 @@
+package talos
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderChartCachesTheManifest(t *testing.T) {
+	t.Chdir(t.TempDir())
+	values := []byte(`{"ipam":{"mode":"kubernetes"}}`)
+	path := chartPath("cilium", ciliumRepo, "1.17.6", values)
+
+	// The script stands in for helm and renders the values it reads from stdin
+	manifest, rendered, err := renderChart(path, `echo "$REPO $VERSION"; cat`, ciliumRepo, "1.17.6", values)
+	if err != nil {
+		t.Fatalf("renderChart: %v", err)
+	}
+	want := ciliumRepo + " 1.17.6\n" + string(values)
+	if !rendered || manifest != want {
+		t.Fatalf("renderChart = %q, %v, want %q rendered", manifest, rendered, want)
+	}
+	if cached, err := os.ReadFile(path); err != nil || string(cached) != want {
+		t.Fatalf("cached chart = %q, %v, want %q", cached, err, want)
+	}
+
+	// Once cached, the chart is read without running helm
+	manifest, rendered, err = renderChart(path, "exit 1", ciliumRepo, "1.17.6", values)
+	if err != nil || rendered || manifest != want {
+		t.Errorf("renderChart from cache = %q, %v, %v, want %q", manifest, rendered, err, want)
+	}
+}
+
+func TestChartPath(t *testing.T) {
+	values := []byte(`{"ipam":{"mode":"kubernetes"}}`)
+	path := chartPath("cilium", ciliumRepo, "v1.17.6", values)
+	if dir := filepath.Join(configDir, chartsDir); filepath.Dir(path) != dir {
+		t.Errorf("chartPath = %s, want a file in %s", path, dir)
+	}
+	if filepath.Base(path)[:14] != "cilium-1.17.6-" {
+		t.Errorf("chartPath = %s, want the chart name and version in the file name", path)
+	}
+	if chartPath("cilium", ciliumRepo, "v1.17.7", values) == path {
+		t.Error("chartPath does not change with the version")
+	}
+	if chartPath("cilium", ciliumRepo, "v1.17.6", []byte(`{}`)) == path {
+		t.Error("chartPath does not change with the values")
+	}
+}
+
+func TestRenderChartReportsHelmErrors(t *testing.T) {
+	t.Chdir(t.TempDir())
+	path := chartPath("cilium", ciliumRepo, "1.17.6", nil)
+	if _, _, err := renderChart(path, "echo no repo >&2; exit 1", ciliumRepo, "1.17.6", nil); err == nil {
+		t.Fatal("renderChart succeeded, want the helm error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("a failed render left %s behind: %v", path, err)
+	}
+}
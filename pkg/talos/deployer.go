@@ -0,0 +1,505 @@
+package talos
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/machine"
+	"proxmox-talos/internal/config"
+	"proxmox-talos/internal/file"
+	"proxmox-talos/internal/types"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// InstalledNodesOutput is the stack output listing the nodes whose configuration was applied,
+// i.e. that have Talos installed to disk and no longer need the ISO.
+const InstalledNodesOutput = "InstalledNodes"
+
+// ControlPlaneNodesOutput is the stack output listing the control plane nodes, i.e. the etcd members.
+const ControlPlaneNodesOutput = "ControlPlaneNodes"
+
+// removeEtcdMemberScript removes the etcd member whose hostname is $MEMBER, if it is still a member,
+// through $NODE. The client configuration is read from stdin so it never touches the command line.
+const removeEtcdMemberScript = `set -eu
+talosconfig=$(mktemp)
+trap 'rm -f "$talosconfig"' EXIT
+cat > "$talosconfig"
+id=$(talosctl --talosconfig "$talosconfig" --nodes "$NODE" --endpoints "$NODE" etcd members | awk -v member="$MEMBER" '$3 == member { print $2 }')
+if [ -n "$id" ]; then
+	talosctl --talosconfig "$talosconfig" --nodes "$NODE" --endpoints "$NODE" etcd remove-member "$id" >&2
+fi`
+
+// configDir is the directory holding the machine config patch templates.
+const configDir = "talos-config"
+
+// PatchLayers returns the patch directories of a node below configDir, from the most general to the
+// most specific: common, the node's role, its pool and the node itself.
+func PatchLayers(node types.Node) []string {
+	return []string{
+		"common",
+		node.Type().String(),
+		filepath.Join("pools", node.Pool().String()),
+		filepath.Join("nodes", node.Name()),
+	}
+}
+
+// PatchFiles returns the patch templates that contribute to a node's config, in merge order.
+func PatchFiles(cfg *config.ClusterConfig, node types.Node) ([]string, error) {
+	files, err := file.GatherPatchFiles(configDir, PatchLayers(node), file.PatchRules{
+		Include: cfg.PatchInclude,
+		Exclude: cfg.PatchExclude,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather configuration files: %w", err)
+	}
+	return files, nil
+}
+
+// Deployer applies machine configuration to the cluster nodes and bootstraps the cluster.
+type Deployer struct {
+	ctx     *pulumi.Context
+	cluster *talosCluster.Cluster
+	config  *config.ClusterConfig
+	images  map[string]*Image
+	// kubernetesVersion is the version the machine configuration is generated for
+	kubernetesVersion string
+	// applied holds the configuration apply of every node, keyed by node name
+	applied map[string]pulumi.Resource
+	// manifests are applied by the control planes when the cluster bootstraps
+	manifests []InlineManifest
+	// retiredBootstrapNode is the removed bootstrap node of the last deployment, which leaves etcd
+	// through the new bootstrap node since its own reset is not graceful
+	retiredBootstrapNode string
+}
+
+// NewDeployer creates a new Deployer for the given cluster whose nodes were created from images,
+// keyed by schematic name.
+func NewDeployer(ctx *pulumi.Context, cluster *talosCluster.Cluster, cfg *config.ClusterConfig, images map[string]*Image) *Deployer {
+	return &Deployer{
+		ctx:     ctx,
+		cluster: cluster,
+		config:  cfg,
+		images:  images,
+		applied: map[string]pulumi.Resource{},
+
+		kubernetesVersion: cluster.KubernetesVersion,
+	}
+}
+
+// SetKubernetesVersion sets the Kubernetes version the machine configuration is generated for.
+// An existing cluster keeps the version it runs, since version changes are rolled out by the KubernetesUpgrader.
+func (d *Deployer) SetKubernetesVersion(version string) {
+	d.kubernetesVersion = version
+}
+
+// SetRetiredBootstrapNode sets the bootstrap node of the last deployment that was removed from the cluster.
+func (d *Deployer) SetRetiredBootstrapNode(name string) {
+	d.retiredBootstrapNode = name
+}
+
+// Applied returns the configuration apply of every deployed node, keyed by node name.
+func (d *Deployer) Applied() map[string]pulumi.Resource {
+	return d.applied
+}
+
+// Deploy applies the machine configuration to every node and bootstraps the bootstrap node.
+func (d *Deployer) Deploy() error {
+	if d.cluster.MachineSecrets == nil {
+		return fmt.Errorf("machine secrets are not generated")
+	}
+
+	manifests, err := ClusterManifests(d.ctx, d.config, d.cluster)
+	if err != nil {
+		return fmt.Errorf("rendering inline manifests: %w", err)
+	}
+	d.manifests = manifests
+
+	bootstrapNode := d.cluster.BootstrapNode()
+	if bootstrapNode == nil {
+		return fmt.Errorf("cluster has no bootstrap node")
+	}
+
+	// The bootstrap node is applied first and every other node depends on it, so that on destroy the
+	// workers drain and the other control planes leave etcd while it still serves the API, and it is
+	// reset last as the final etcd member. Apart from that the nodes are applied in parallel.
+	ordered := []types.Node{bootstrapNode}
+	for _, node := range d.cluster.Nodes {
+		if node != bootstrapNode {
+			ordered = append(ordered, node)
+		}
+	}
+
+	for _, node := range ordered {
+		d.ctx.Log.Info(fmt.Sprintf("Creating Talos Node for type %s and name %s", node.Type().String(), node.Name()), nil)
+
+		var dependsOn []pulumi.Resource
+		if node != bootstrapNode {
+			dependsOn = append(dependsOn, d.applied[bootstrapNode.Name()])
+		}
+
+		apply, err := d.applyConfiguration(node, dependsOn)
+		if err != nil {
+			return fmt.Errorf("applying configuration to node %s: %w", node.Name(), err)
+		}
+		d.applied[node.Name()] = apply
+
+		if node == bootstrapNode {
+			if err := d.bootstrap(node, apply); err != nil {
+				return fmt.Errorf("bootstrapping node %s: %w", node.Name(), err)
+			}
+		}
+	}
+
+	if d.retiredBootstrapNode != "" {
+		if err := d.removeEtcdMember(d.retiredBootstrapNode, bootstrapNode); err != nil {
+			return fmt.Errorf("removing node %s from etcd: %w", d.retiredBootstrapNode, err)
+		}
+	}
+
+	var installed []any
+	var controlPlanes []string
+	for _, node := range d.cluster.Nodes {
+		installed = append(installed, d.applied[node.Name()].(*machine.ConfigurationApply).ID())
+		if node.Type() == types.ControlPlane {
+			controlPlanes = append(controlPlanes, node.Name())
+		}
+	}
+
+	// The next deployment declares the CD-ROM of every node listed here empty
+	names := make([]string, len(d.cluster.Nodes))
+	for i, node := range d.cluster.Nodes {
+		names[i] = node.Name()
+	}
+	d.ctx.Export(InstalledNodesOutput, pulumi.All(installed...).ApplyT(func([]any) []string {
+		return names
+	}).(pulumi.StringArrayOutput))
+	d.ctx.Export(ControlPlaneNodesOutput, pulumi.ToStringArray(controlPlanes))
+
+	return nil
+}
+
+// applyConfiguration generates the machine configuration for a node and applies it together with its patches.
+// When the node is removed, it is cordoned, drained, removed from etcd and reset before its VM is deleted,
+// which depends on the apply through the node's IP. The bootstrap node is reset without leaving etcd,
+// since it is the last member when the cluster is destroyed and a graceful reset of it fails.
+// Nothing is applied unless the merged config passes the schema check. That check needs the generated
+// config and the installer, which are unknown while previewing a new stack, so it runs during the preview
+// of a deployed stack and before the apply of every up; NodeConfigPatches checks the known patches merged
+// in every preview.
+func (d *Deployer) applyConfiguration(node types.Node, dependsOn []pulumi.Resource) (*machine.ConfigurationApply, error) {
+	configuration := machine.GetConfigurationOutput(d.ctx, machine.GetConfigurationOutputArgs{
+		ClusterName:       pulumi.String(d.cluster.Name),
+		MachineType:       pulumi.String(node.Type().String()),
+		ClusterEndpoint:   pulumi.String(d.cluster.KubernetesAPI),
+		TalosVersion:      pulumi.String(d.cluster.TalosVersion),
+		KubernetesVersion: pulumi.String(d.kubernetesVersion),
+		Docs:              pulumi.Bool(false),
+		Examples:          pulumi.Bool(false),
+		MachineSecrets:    d.cluster.MachineSecrets.MachineSecrets,
+	})
+
+	configPatches, err := d.configPatches(node)
+	if err != nil {
+		return nil, err
+	}
+
+	// The apply merges the patches itself, so the merged config is generated separately to validate it
+	// the way render mode validates the written config before anything is applied
+	merged := machine.GetConfigurationOutput(d.ctx, machine.GetConfigurationOutputArgs{
+		ClusterName:       pulumi.String(d.cluster.Name),
+		MachineType:       pulumi.String(node.Type().String()),
+		ClusterEndpoint:   pulumi.String(d.cluster.KubernetesAPI),
+		TalosVersion:      pulumi.String(d.cluster.TalosVersion),
+		KubernetesVersion: pulumi.String(d.kubernetesVersion),
+		Docs:              pulumi.Bool(false),
+		Examples:          pulumi.Bool(false),
+		MachineSecrets:    d.cluster.MachineSecrets.MachineSecrets,
+		ConfigPatches:     configPatches,
+	})
+	name := fmt.Sprintf("%s machine config", node.Name())
+	validated := pulumi.All(configuration.MachineConfiguration(), merged.MachineConfiguration()).ApplyT(func(args []any) (string, error) {
+		if err := ValidateConfig(name, []byte(args[1].(string)), d.cluster.TalosVersion); err != nil {
+			return "", fmt.Errorf("invalid machine config, lines refer to the merged config:\n%w", err)
+		}
+		return args[0].(string), nil
+	}).(pulumi.StringOutput)
+
+	apply, err := machine.NewConfigurationApply(d.ctx, fmt.Sprintf("%s-configuration-apply", node.Name()), &machine.ConfigurationApplyArgs{
+		ClientConfiguration:       d.cluster.MachineSecrets.ClientConfiguration,
+		MachineConfigurationInput: validated,
+		Node:                      pulumi.String(node.Name()),
+		ConfigPatches:             configPatches,
+		Endpoint:                  node.IP(),
+		OnDestroy: &machine.ConfigurationApplyOnDestroyArgs{
+			Graceful: pulumi.Bool(!node.IsBootstrap()),
+			Reset:    pulumi.Bool(true),
+			Reboot:   pulumi.Bool(false),
+		},
+	}, pulumi.DependsOn(dependsOn))
+	if err != nil {
+		return nil, err
+	}
+
+	return apply, nil
+}
+
+// configPatches returns the config patches of a node, installing the image of the node's schematic.
+func (d *Deployer) configPatches(node types.Node) (pulumi.StringArray, error) {
+	image, ok := d.images[node.Pool().Schematic]
+	if !ok {
+		return nil, fmt.Errorf("no image for schematic %s", node.Pool().Schematic)
+	}
+
+	files, err := PatchFiles(d.config, node)
+	if err != nil {
+		return nil, err
+	}
+	d.ctx.Log.Info(fmt.Sprintf("Node %s uses patch files %s", node.Name(), strings.Join(files, ", ")), nil)
+
+	return NodeConfigPatches(d.config, d.cluster, node, files, image.Installer(d.cluster.TalosVersion), d.manifests)
+}
+
+// NodeConfigPatches returns the install patch for the installer image, the rendered patch templates
+// in files, the node's static address, the API endpoint and CNI settings, the inline and extra manifests
+// of a control plane and the labels and taints of the node's pool. The generated patches are validated
+// like the patch templates, and all patches that are known during preview are validated merged.
+func NodeConfigPatches(cfg *config.ClusterConfig, cluster *talosCluster.Cluster, node types.Node, files []string, installer pulumi.StringInput, manifests []InlineManifest) (pulumi.StringArray, error) {
+	// The installer carries the schematic's extensions, so upgrades and reinstalls keep them
+	installPatch := installer.ToStringOutput().ApplyT(func(installer string) (string, error) {
+		patch, err := json.Marshal(map[string]any{
+			"machine": map[string]any{
+				"install": map[string]any{
+					"disk":  "/dev/vda",
+					"image": installer,
+				},
+			},
+		})
+		return string(patch), err
+	}).(pulumi.StringOutput)
+
+	configPatches := pulumi.StringArray{installPatch}
+
+	filePatches, err := RenderPatches(files, NewTemplateContext(cfg, cluster, node))
+	if err != nil {
+		return nil, err
+	}
+	for _, filePatch := range filePatches {
+		configPatches = append(configPatches, pulumi.String(string(filePatch)))
+	}
+	// known collects the patches that are known during preview, for the check of them merged
+	known := append([][]byte{}, filePatches...)
+
+	// generated adds a generated patch once it passes the schema check
+	generated := func(name string, patch []byte) error {
+		if err := ValidateConfig(name+" patch", patch, cluster.TalosVersion); err != nil {
+			return fmt.Errorf("invalid %s patch:\n%w", name, err)
+		}
+		configPatches = append(configPatches, pulumi.String(string(patch)))
+		known = append(known, patch)
+		return nil
+	}
+
+	// In vip mode the control planes hold the VIP on the interface that has their static address,
+	// so both go on the same interface entry, selected by vipDeviceSelector
+	vip := cfg.VIP()
+	holdsVIP := vip.IsValid() && cfg.APIEndpointMode == types.APIEndpointVIP && node.Type() == types.ControlPlane
+	selector := DefaultDeviceSelector
+	if holdsVIP && len(cfg.VIPDeviceSelector) > 0 {
+		selector = cfg.VIPDeviceSelector
+	}
+	// Interfaces in the patch files only conflict with an interface entry generated for the node
+	hasAddress := node.Address() != "" && cfg.Addressing != nil
+	if hasAddress || holdsVIP {
+		if err := checkInterfaceSelector(filePatches, selector); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasAddress {
+		addressPatch, err := NewStaticAddressPatch(node.Address(), cfg.Addressing.Gateway, cfg.Addressing.DNSServers, selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create static address patch: %w", err)
+		}
+		if err := generated("static address", addressPatch); err != nil {
+			return nil, err
+		}
+	}
+
+	// In vip mode the control planes share the endpoint IP, Talos moves it to a healthy node
+	if holdsVIP {
+		vipPatch, err := NewVIPPatch(vip.String(), selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create VIP patch: %w", err)
+		}
+		if err := generated("VIP", vipPatch); err != nil {
+			return nil, err
+		}
+	}
+
+	// The API certificates must be valid for every name and IP clients reach the endpoint by
+	if node.Type() == types.ControlPlane {
+		sansPatch, err := NewCertSANsPatch(cfg.APISANs())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create certificate SANs patch: %w", err)
+		}
+		if err := generated("certificate SANs", sansPatch); err != nil {
+			return nil, err
+		}
+
+		portPatch, err := NewAPIServerPortPatch(cfg.APIServerPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create API server port patch: %w", err)
+		}
+		if len(portPatch) > 0 {
+			if err := generated("API server port", portPatch); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cniPatch, err := NewCNIPatch(cfg.CNI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CNI patch: %w", err)
+	}
+	if len(cniPatch) > 0 {
+		if err := generated("CNI", cniPatch); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only control planes apply manifests, so the CNI is up right after bootstrap
+	if node.Type() == types.ControlPlane {
+		if len(manifests) > 0 {
+			configPatches = append(configPatches, NewInlineManifestsPatch(manifests))
+		}
+
+		extraPatch, err := NewExtraManifestsPatch(cfg.ExtraManifests)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create extra manifests patch: %w", err)
+		}
+		if len(extraPatch) > 0 {
+			if err := generated("extra manifests", extraPatch); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	poolPatch, err := NewNodePoolPatch(node.Pool())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create node pool patch: %w", err)
+	}
+	if len(poolPatch) > 0 {
+		if err := generated("node pool", poolPatch); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := ValidatePatches(node.Name()+" patches", known, cluster.TalosVersion); err != nil {
+		return nil, fmt.Errorf("invalid patches, lines refer to the merged patches:\n%w", err)
+	}
+
+	return configPatches, nil
+}
+
+// removeEtcdMember removes a retired bootstrap node from etcd through the current bootstrap node before the
+// retired node is reset, which happens after every create and update of the deployment.
+func (d *Deployer) removeEtcdMember(name string, through types.Node) error {
+	_, err := local.NewCommand(d.ctx, fmt.Sprintf("%s-etcd-remove-member", name), &local.CommandArgs{
+		Create: pulumi.String(removeEtcdMemberScript),
+		Stdin:  pulumi.ToSecret(TalosConfig(d.ctx, d.cluster)).(pulumi.StringOutput),
+		Environment: pulumi.StringMap{
+			"NODE":   through.IP(),
+			"MEMBER": pulumi.String(name),
+		},
+	}, pulumi.DependsOn([]pulumi.Resource{d.applied[through.Name()]}))
+	return err
+}
+
+// bootstrap bootstraps etcd on the given node once its configuration has been applied.
+func (d *Deployer) bootstrap(node types.Node, apply *machine.ConfigurationApply) error {
+	bootstrap, err := machine.NewBootstrap(d.ctx, "bootstrap", &machine.BootstrapArgs{
+		ClientConfiguration: d.cluster.MachineSecrets.ClientConfiguration,
+		Node:                node.IP(),
+	}, pulumi.DependsOn([]pulumi.Resource{apply}), pulumi.Timeouts(&pulumi.CustomTimeouts{
+		Create: "10m",
+	}),
+		// etcd is bootstrapped once, so moving the bootstrap role to another node must not re-bootstrap it
+		pulumi.IgnoreChanges([]string{"node", "endpoint"}))
+	if err != nil {
+		return err
+	}
+
+	d.cluster.Bootstrap = bootstrap
+	d.ctx.Log.Info(fmt.Sprintf("Node %s is bootstrapped", node.Name()), nil)
+	return nil
+}
+
+// RenderPatches renders the patch templates with data, validates them against the Talos schema and
+// returns JSON config patches in template order. Consecutive plain patches are merged into one patch
+// per machine config document, the v1alpha1 config first. A template with $patch directives or
+// JSON6902 operations is passed on as its own patches, since those apply to the config Talos generates,
+// not only to the patches before it. Templates can include the partials in configDir. Validation
+// errors point at the template line that produced the invalid rendered line.
+func RenderPatches(files []string, data TemplateContext) ([][]byte, error) {
+	var patches [][]byte
+	var plain []patchSource
+	// flush merges the pending plain patches
+	flush := func() error {
+		if len(plain) == 0 {
+			return nil
+		}
+		merged, err := mergeSources(plain)
+		if err != nil {
+			return fmt.Errorf("failed to merge configuration files: %w", err)
+		}
+		split, err := SplitPatches([]byte(merged))
+		if err != nil {
+			return fmt.Errorf("failed to convert configuration to JSON: %w", err)
+		}
+		patches = append(patches, split...)
+		plain = nil
+		return nil
+	}
+
+	for _, path := range files {
+		rendered, err := renderTemplate(path, data)
+		if err != nil {
+			return nil, err
+		}
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if err := ValidateTemplate(path, source, rendered, data.Versions.Talos); err != nil {
+			return nil, fmt.Errorf("invalid configuration:\n%w", err)
+		}
+
+		appliesToBase, err := patchesGeneratedConfig(rendered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		if !appliesToBase {
+			plain = append(plain, patchSource{Name: path, Content: rendered})
+			continue
+		}
+
+		if err := flush(); err != nil {
+			return nil, err
+		}
+		split, err := SplitPatches(rendered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s to JSON: %w", path, err)
+		}
+		patches = append(patches, split...)
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return patches, nil
+}
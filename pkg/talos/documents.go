@@ -0,0 +1,131 @@
+package talos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// documentKinds lists the machine config document kinds besides the v1alpha1 config in the order
+// they are passed to Talos, so that e.g. the network default action precedes the rules it applies to.
+var documentKinds = []string{
+	"NetworkDefaultActionConfig",
+	"NetworkRuleConfig",
+	"Layer2VIPConfig",
+	"EthernetConfig",
+	"VolumeConfig",
+	"UserVolumeConfig",
+	"RawVolumeConfig",
+	"ExistingVolumeConfig",
+	"SwapVolumeConfig",
+	"ZswapConfig",
+	"ExtensionServiceConfig",
+	"TrustedRootsConfig",
+	"KmsgLogConfig",
+	"EventSinkConfig",
+	"WatchdogTimerConfig",
+	"SideroLinkConfig",
+	"ImageCacheConfig",
+}
+
+// document is a single machine config document. The v1alpha1 config has no kind.
+type document struct {
+	Kind string
+	Name string
+	Body any
+}
+
+// key identifies the document: documents with the same key are merged.
+func (d document) key() string {
+	return d.Kind + "/" + d.Name
+}
+
+// order returns the position of the document's kind in the config, the v1alpha1 config first.
+func (d document) order() int {
+	if d.Kind == "" {
+		return 0
+	}
+	for i, kind := range documentKinds {
+		if kind == d.Kind {
+			return i + 1
+		}
+	}
+	return len(documentKinds) + 1
+}
+
+// parseDocuments splits YAML content into its machine config documents, skipping empty ones.
+func parseDocuments(content []byte) ([]document, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+
+	var documents []document
+	for {
+		var body any
+		err := decoder.Decode(&body)
+		if errors.Is(err, io.EOF) {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			continue
+		}
+
+		doc, err := newDocument(convertKeysToString(body))
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", len(documents)+1, err)
+		}
+		documents = append(documents, doc)
+	}
+}
+
+// newDocument identifies a parsed document by its kind and name.
+func newDocument(body any) (document, error) {
+	m, ok := body.(map[string]any)
+	if !ok {
+		// JSON6902 operations patch the v1alpha1 config
+		return document{Body: body}, nil
+	}
+
+	kind, _ := m["kind"].(string)
+	if kind == "" {
+		return document{Body: body}, nil
+	}
+	if (document{Kind: kind}).order() > len(documentKinds) {
+		return document{}, fmt.Errorf("unknown document kind %s, known kinds are %s", kind, strings.Join(documentKinds, ", "))
+	}
+	if _, ok := m["apiVersion"].(string); !ok {
+		return document{}, fmt.Errorf("%s document has no apiVersion", kind)
+	}
+
+	name, _ := m["name"].(string)
+	return document{Kind: kind, Name: name, Body: body}, nil
+}
+
+// sortDocuments orders documents by kind, the v1alpha1 config first, and then by name.
+func sortDocuments(documents []document) {
+	sort.SliceStable(documents, func(i, j int) bool {
+		if documents[i].order() != documents[j].order() {
+			return documents[i].order() < documents[j].order()
+		}
+		return documents[i].Name < documents[j].Name
+	})
+}
+
+// marshalDocuments renders documents as a multi-document YAML stream.
+func marshalDocuments(documents []document) (string, error) {
+	parts := make([]string, 0, len(documents))
+	for _, doc := range documents {
+		out, err := yaml.Marshal(doc.Body)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal %s document: %w", doc.key(), err)
+		}
+		parts = append(parts, string(out))
+	}
+	return strings.Join(parts, "---\n"), nil
+}
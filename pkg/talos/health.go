@@ -0,0 +1,47 @@
+package talos
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/cluster"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/machine"
+	"proxmox-talos/internal/types"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// healthTimeout bounds a single cluster health check.
+const healthTimeout = "10m"
+
+// HealthGate returns an output that resolves once after has resolved and, if check is true,
+// the cluster has passed a Talos health check. It resolves to "healthy" or "skipped".
+func HealthGate(ctx *pulumi.Context, c *talosCluster.Cluster, after pulumi.Input, check pulumi.BoolInput) pulumi.StringOutput {
+	controlPlanes := c.GetNodesByType(types.ControlPlane)
+	workers := c.GetNodesByType(types.Worker)
+
+	return pulumi.All(after, check, c.MachineSecrets.ClientConfiguration, pulumi.ToStringArrayOutput(controlPlanes), pulumi.ToStringArrayOutput(workers)).
+		ApplyT(func(args []any) (string, error) {
+			if !args[1].(bool) {
+				return "skipped", nil
+			}
+
+			clientConfig := args[2].(machine.ClientConfiguration)
+			controlPlaneIPs := args[3].([]string)
+			timeout := healthTimeout
+			_, err := cluster.GetHealth(ctx, &cluster.GetHealthArgs{
+				ClientConfiguration: cluster.GetHealthClientConfiguration{
+					CaCertificate:     clientConfig.CaCertificate,
+					ClientCertificate: clientConfig.ClientCertificate,
+					ClientKey:         clientConfig.ClientKey,
+				},
+				ControlPlaneNodes: controlPlaneIPs,
+				WorkerNodes:       args[4].([]string),
+				Endpoints:         controlPlaneIPs,
+				Timeouts:          &cluster.GetHealthTimeouts{Read: &timeout},
+			})
+			if err != nil {
+				return "", fmt.Errorf("cluster is not healthy: %w", err)
+			}
+			return "healthy", nil
+		}).(pulumi.StringOutput)
+}
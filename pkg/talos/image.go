@@ -0,0 +1,116 @@
+package talos
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/imagefactory"
+	"gopkg.in/yaml.v3"
+	"proxmox-talos/internal/config"
+	"proxmox-talos/internal/types"
+)
+
+// Image is a Talos image built by the image factory from a schematic.
+type Image struct {
+	// Name identifies the image among the cluster's images and is used in resource and file names.
+	Name      string
+	Schematic *imagefactory.Schematic
+	Urls      imagefactory.GetUrlsResultOutput
+}
+
+// installerRepository is the image factory registry path of the Talos installer.
+const installerRepository = "factory.talos.dev/installer"
+
+// SchematicIDsOutput is the stack output mapping the digest of every registered schematic to its
+// image factory ID, which render mode needs to name installer images without registering schematics.
+const SchematicIDsOutput = "TalosSchematicIDs"
+
+// Installer returns the installer image reference for the image's schematic and the given Talos version.
+func (i *Image) Installer(talosVersion string) pulumi.StringOutput {
+	return i.Schematic.ID().ToStringOutput().ApplyT(func(schematicID string) string {
+		return InstallerImage(schematicID, talosVersion)
+	}).(pulumi.StringOutput)
+}
+
+// InstallerImage returns the image factory installer reference for a schematic ID and Talos version.
+func InstallerImage(schematicID, talosVersion string) string {
+	return fmt.Sprintf("%s/%s:%s", installerRepository, schematicID, talosVersion)
+}
+
+// NewSchematic renders a schematic as the YAML document the image factory expects.
+func NewSchematic(schematic *types.Schematic) ([]byte, error) {
+	return yaml.Marshal(schematic)
+}
+
+// SchematicDigest returns the key of a rendered schematic in SchematicIDsOutput.
+func SchematicDigest(content []byte) string {
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:])
+}
+
+// CreateTalosImages registers every configured schematic with the image factory and returns the
+// download URLs for the configured version, architecture and platform, keyed by schematic name.
+// Schematics with identical content share one Image, since the factory gives them the same ID.
+func CreateTalosImages(ctx *pulumi.Context, cfg *config.ClusterConfig) (map[string]*Image, error) {
+	names := make([]string, 0, len(cfg.Schematics))
+	for name := range cfg.Schematics {
+		names = append(names, name)
+	}
+	// The default schematic is created first so it keeps the original resource name
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == types.DefaultSchematic) != (names[j] == types.DefaultSchematic) {
+			return names[i] == types.DefaultSchematic
+		}
+		return names[i] < names[j]
+	})
+
+	images := make(map[string]*Image, len(names))
+	byContent := map[string]*Image{}
+	ids := pulumi.StringMap{}
+	for _, name := range names {
+		schematic := cfg.Schematics[name]
+		content, err := NewSchematic(&schematic)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal schematic %s: %w", name, err)
+		}
+
+		if image, ok := byContent[string(content)]; ok {
+			images[name] = image
+			continue
+		}
+
+		resourceName := "talos-image-from-factory"
+		imageName := cfg.ClusterName
+		if name != types.DefaultSchematic {
+			resourceName = fmt.Sprintf("talos-image-%s", name)
+			imageName = fmt.Sprintf("%s-%s", cfg.ClusterName, name)
+		}
+
+		talosImage, err := imagefactory.NewSchematic(ctx, resourceName, &imagefactory.SchematicArgs{
+			Schematic: pulumi.String(string(content)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create schematic %s: %w", name, err)
+		}
+
+		image := &Image{
+			Name:      imageName,
+			Schematic: talosImage,
+			Urls: imagefactory.GetUrlsOutput(ctx, imagefactory.GetUrlsOutputArgs{
+				Architecture: pulumi.String(cfg.TalosArch),
+				Platform:     pulumi.String(cfg.TalosPlatform),
+				SchematicId:  talosImage.ID().ToStringOutput(),
+				TalosVersion: pulumi.String(cfg.TalosVersion),
+			}),
+		}
+		byContent[string(content)] = image
+		images[name] = image
+		ids[SchematicDigest(content)] = talosImage.ID().ToStringOutput()
+	}
+
+	ctx.Export(SchematicIDsOutput, ids)
+	return images, nil
+}
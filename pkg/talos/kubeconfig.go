@@ -0,0 +1,83 @@
+package talos
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/cluster"
+	"proxmox-talos/internal/file"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+	"sigs.k8s.io/yaml"
+)
+
+// kubeconfigFile is the local file the generated kubeconfig is written to.
+const kubeconfigFile = "kubeconfig.yaml"
+
+// KubeconfigOutput is the stack output holding the kubeconfig, which every version of this program exports.
+const KubeconfigOutput = "Kubeconfig"
+
+// GenerateKubeconfig retrieves the kubeconfig from the bootstrap node, points it at the cluster's
+// Kubernetes API endpoint, writes it to disk and exports it.
+func GenerateKubeconfig(ctx *pulumi.Context, c *talosCluster.Cluster) error {
+	if c.MachineSecrets == nil {
+		return fmt.Errorf("machine secrets are not generated")
+	}
+	if c.Bootstrap == nil {
+		return fmt.Errorf("cluster has not been bootstrapped")
+	}
+
+	bootstrapNode := c.BootstrapNode()
+	if bootstrapNode == nil {
+		return fmt.Errorf("cluster has no bootstrap node")
+	}
+
+	clientConfig := c.MachineSecrets.ClientConfiguration
+	k, err := cluster.NewKubeconfig(ctx, "talos-kubeconfig", &cluster.KubeconfigArgs{
+		ClientConfiguration: &cluster.KubeconfigClientConfigurationArgs{
+			ClientCertificate: clientConfig.ClientCertificate(),
+			ClientKey:         clientConfig.ClientKey(),
+			CaCertificate:     clientConfig.CaCertificate(),
+		},
+		Node: bootstrapNode.IP(),
+	}, pulumi.DependsOn([]pulumi.Resource{c.Bootstrap, c.MachineSecrets}))
+	if err != nil {
+		return fmt.Errorf("failed to generate kubeconfig: %w", err)
+	}
+
+	c.Kubeconfig = k.KubeconfigRaw.ApplyT(func(kubeconfig string) (string, error) {
+		kubeconfig, err := setKubeconfigServer(kubeconfig, c.KubernetesAPI)
+		if err != nil {
+			return "", err
+		}
+		if err := file.WriteToFile(kubeconfigFile, kubeconfig); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", kubeconfigFile, err)
+		}
+		return kubeconfig, nil
+	}).(pulumi.StringOutput)
+
+	ctx.Export(KubeconfigOutput, pulumi.ToSecret(c.Kubeconfig))
+	return nil
+}
+
+// setKubeconfigServer sets the server of every cluster in a kubeconfig to endpoint.
+func setKubeconfigServer(kubeconfig, endpoint string) (string, error) {
+	var config map[string]any
+	if err := yaml.Unmarshal([]byte(kubeconfig), &config); err != nil {
+		return "", fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	clusters, _ := config["clusters"].([]any)
+	for _, entry := range clusters {
+		if named, ok := entry.(map[string]any); ok {
+			if cluster, ok := named["cluster"].(map[string]any); ok {
+				cluster["server"] = endpoint
+			}
+		}
+	}
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal kubeconfig: %w", err)
+	}
+	return string(out), nil
+}
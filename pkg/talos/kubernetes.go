@@ -0,0 +1,98 @@
+package talos
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"proxmox-talos/internal/types"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// KubernetesVersionOutput is the stack output holding the Kubernetes version the cluster runs.
+const KubernetesVersionOutput = "KubernetesVersion"
+
+// recordVersionScript records the Kubernetes version a freshly created cluster already runs.
+const recordVersionScript = `printf '%s' "$VERSION"`
+
+// upgradeKubernetesScript upgrades the control plane static pods and then the kubelets of every node
+// to $VERSION with talosctl, unless the cluster already runs it.
+const upgradeKubernetesScript = `set -eu
+if [ "${PULUMI_COMMAND_STDOUT:-}" = "$VERSION" ]; then
+	printf '%s' "$VERSION"
+	exit 0
+fi
+talosconfig=$(mktemp)
+trap 'rm -f "$talosconfig"' EXIT
+cat > "$talosconfig"
+talosctl --talosconfig "$talosconfig" --nodes "$NODE" --endpoints "$NODE" upgrade-k8s --to "${VERSION#v}" >&2
+printf '%s' "$VERSION"`
+
+// KubernetesUpgrader upgrades the Kubernetes components of the cluster when its Kubernetes version changes.
+type KubernetesUpgrader struct {
+	ctx     *pulumi.Context
+	cluster *talosCluster.Cluster
+	// running is the version the cluster ran after the last deployment, empty for a new cluster
+	running string
+}
+
+// NewKubernetesUpgrader creates a KubernetesUpgrader for a cluster currently running the given version.
+func NewKubernetesUpgrader(ctx *pulumi.Context, cluster *talosCluster.Cluster, running string) *KubernetesUpgrader {
+	return &KubernetesUpgrader{
+		ctx:     ctx,
+		cluster: cluster,
+		running: running,
+	}
+}
+
+// Check verifies that the cluster can move from its running Kubernetes version to the configured one,
+// and that the configured Talos version still supports the running version during the Talos rollout.
+func (k *KubernetesUpgrader) Check() error {
+	if k.running == "" || k.running == k.cluster.KubernetesVersion {
+		return nil
+	}
+
+	if err := types.CheckKubernetesCompatibility(k.cluster.TalosVersion, k.running); err != nil {
+		return fmt.Errorf("nodes are upgraded before kubernetes: %w", err)
+	}
+	return types.CheckKubernetesUpgrade(k.running, k.cluster.KubernetesVersion)
+}
+
+// Upgrade runs the Kubernetes upgrade once after has resolved and the cluster is healthy,
+// and checks the cluster health again afterwards. applied lists the resources that must finish first.
+func (k *KubernetesUpgrader) Upgrade(after pulumi.StringOutput, applied []pulumi.Resource) error {
+	if err := k.Check(); err != nil {
+		return err
+	}
+
+	bootstrap := k.cluster.BootstrapNode()
+	if bootstrap == nil {
+		return fmt.Errorf("cluster has no bootstrap node")
+	}
+
+	needsUpgrade := k.running != "" && k.running != k.cluster.KubernetesVersion
+	if needsUpgrade {
+		k.ctx.Log.Info(fmt.Sprintf("Upgrading kubernetes from %s to %s", k.running, k.cluster.KubernetesVersion), nil)
+	}
+
+	gate := HealthGate(k.ctx, k.cluster, after, pulumi.Bool(needsUpgrade))
+
+	cmd, err := local.NewCommand(k.ctx, "kubernetes-upgrade", &local.CommandArgs{
+		Create: pulumi.String(recordVersionScript),
+		Update: pulumi.String(upgradeKubernetesScript),
+		Stdin:  pulumi.ToSecret(TalosConfig(k.ctx, k.cluster)).(pulumi.StringOutput),
+		Environment: pulumi.StringMap{
+			"NODE":    bootstrap.IP(),
+			"VERSION": pulumi.String(k.cluster.KubernetesVersion),
+			// Resolves to "" once the health gate passed, so it only orders the upgrade
+			"HEALTH_GATE": gate.ApplyT(func(string) string { return "" }).(pulumi.StringOutput),
+		},
+	}, pulumi.DependsOn(applied))
+	if err != nil {
+		return fmt.Errorf("creating kubernetes upgrade: %w", err)
+	}
+
+	k.ctx.Export(KubernetesVersionOutput, cmd.Stdout)
+	k.ctx.Export("KubernetesUpgradeHealth", HealthGate(k.ctx, k.cluster, cmd.Stdout, pulumi.Bool(needsUpgrade)))
+	return nil
+}
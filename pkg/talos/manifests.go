@@ -0,0 +1,268 @@
+package talos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"gopkg.in/yaml.v3"
+	"proxmox-talos/internal/config"
+	"proxmox-talos/internal/file"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// manifestsDir holds the Kubernetes manifest templates below configDir that the control planes apply.
+const manifestsDir = "manifests"
+
+// maxInlineManifestsSize limits the inline manifests of a control plane. Talos receives the machine
+// config in a single gRPC message of at most 4 MiB, which must leave room for the rest of the config.
+const maxInlineManifestsSize = 3 << 20
+
+// builtinNamespaces exist in every cluster before any manifest is applied.
+var builtinNamespaces = map[string]bool{
+	"default":         true,
+	"kube-system":     true,
+	"kube-public":     true,
+	"kube-node-lease": true,
+}
+
+// InlineManifest is a Kubernetes manifest the control planes apply when the cluster bootstraps.
+type InlineManifest struct {
+	Name     string
+	Contents pulumi.StringInput
+}
+
+// InlineManifestsPatch represents the inline manifests of the control plane config.
+type InlineManifestsPatch struct {
+	Cluster struct {
+		InlineManifests []InlineManifestEntry `json:"inlineManifests"`
+	} `json:"cluster"`
+}
+
+// InlineManifestEntry represents a single Talos inline manifest.
+type InlineManifestEntry struct {
+	Name     string `json:"name"`
+	Contents string `json:"contents"`
+}
+
+// ExtraManifestsPatch represents the manifests the control planes download and apply.
+type ExtraManifestsPatch struct {
+	Cluster struct {
+		ExtraManifests []string `json:"extraManifests"`
+	} `json:"cluster"`
+}
+
+// ClusterManifests returns the inline manifests of the control planes in the order Talos applies them:
+// the CNI first, so that the cluster is networked, then the templates in the manifests directory.
+func ClusterManifests(ctx *pulumi.Context, cfg *config.ClusterConfig, cluster *talosCluster.Cluster) ([]InlineManifest, error) {
+	manifests, err := CNIManifests(ctx, cfg.CNI)
+	if err != nil {
+		return nil, fmt.Errorf("rendering CNI manifests: %w", err)
+	}
+
+	dirManifests, err := DirManifests(cfg, cluster)
+	if err != nil {
+		return nil, err
+	}
+	manifests = append(manifests, dirManifests...)
+
+	names := map[string]bool{}
+	for _, manifest := range manifests {
+		if names[manifest.Name] {
+			return nil, fmt.Errorf("duplicate inline manifest %s", manifest.Name)
+		}
+		names[manifest.Name] = true
+	}
+	return manifests, nil
+}
+
+// DirManifests renders the manifest templates in the manifests directory with the cluster template
+// context. Files are ordered like patch files, by priority prefix and then by path, and each becomes
+// an inline manifest named after its path below the directory.
+func DirManifests(cfg *config.ClusterConfig, cluster *talosCluster.Cluster) ([]InlineManifest, error) {
+	files, err := file.GatherPatchFiles(configDir, []string{manifestsDir}, file.PatchRules{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather manifest files: %w", err)
+	}
+
+	data := NewClusterTemplateContext(cfg, cluster)
+	manifests := make([]InlineManifest, 0, len(files))
+	for _, path := range files {
+		rendered, err := renderTemplate(path, data)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parseManifestObjects(rendered); err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+		}
+		manifests = append(manifests, InlineManifest{
+			Name:     manifestName(path),
+			Contents: pulumi.String(string(rendered)),
+		})
+	}
+	return manifests, nil
+}
+
+// manifestName returns the name of the inline manifest rendered from path, its path below the
+// manifests directory without extensions, e.g. "monitoring-10-namespace".
+func manifestName(path string) string {
+	name, err := filepath.Rel(filepath.Join(configDir, manifestsDir), path)
+	if err != nil {
+		name = filepath.Base(path)
+	}
+	name = strings.TrimSuffix(filepath.ToSlash(name), ".tmpl")
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".yaml"), ".yml")
+	return strings.ReplaceAll(name, "/", "-")
+}
+
+// NewInlineManifestsPatch creates a JSON patch that adds manifests to the control plane config
+// once their contents are known, after checking their order and size.
+func NewInlineManifestsPatch(manifests []InlineManifest) pulumi.StringOutput {
+	contents := make([]interface{}, len(manifests))
+	for i, manifest := range manifests {
+		contents[i] = manifest.Contents
+	}
+
+	return pulumi.All(contents...).ApplyT(func(args []interface{}) (string, error) {
+		patch := InlineManifestsPatch{}
+		for i, manifest := range manifests {
+			patch.Cluster.InlineManifests = append(patch.Cluster.InlineManifests, InlineManifestEntry{
+				Name:     manifest.Name,
+				Contents: args[i].(string),
+			})
+		}
+		if err := checkInlineManifests(patch.Cluster.InlineManifests); err != nil {
+			return "", err
+		}
+		out, err := json.Marshal(patch)
+		return string(out), err
+	}).(pulumi.StringOutput)
+}
+
+// NewExtraManifestsPatch creates a JSON patch that makes the control planes apply the manifests at urls.
+// It returns nil if there are none.
+func NewExtraManifestsPatch(urls []string) ([]byte, error) {
+	if len(urls) == 0 {
+		return nil, nil
+	}
+
+	patch := ExtraManifestsPatch{}
+	patch.Cluster.ExtraManifests = urls
+	return json.Marshal(patch)
+}
+
+// manifestObject identifies a Kubernetes object of a manifest.
+type manifestObject struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Group string `yaml:"group"`
+		Names struct {
+			Kind string `yaml:"kind"`
+		} `yaml:"names"`
+	} `yaml:"spec"`
+}
+
+// group returns the API group of the object, empty for the core group.
+func (o manifestObject) group() string {
+	if i := strings.LastIndex(o.APIVersion, "/"); i >= 0 {
+		return o.APIVersion[:i]
+	}
+	return ""
+}
+
+// parseManifestObjects returns the objects of a multi-document manifest, skipping empty documents.
+func parseManifestObjects(content []byte) ([]manifestObject, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+
+	var objects []manifestObject
+	for {
+		var node yaml.Node
+		err := decoder.Decode(&node)
+		if errors.Is(err, io.EOF) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(node.Content) == 0 || node.Content[0].Tag == "!!null" {
+			continue
+		}
+
+		var object manifestObject
+		if err := node.Decode(&object); err != nil {
+			return nil, fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		if object.APIVersion == "" || object.Kind == "" {
+			return nil, fmt.Errorf("line %d: object has no apiVersion or kind", node.Line)
+		}
+		objects = append(objects, object)
+	}
+}
+
+// checkInlineManifests checks that the manifests fit into the machine config and that no object uses
+// a namespace or custom resource definition created by a later object, since Talos applies the
+// manifests and their objects in order.
+func checkInlineManifests(manifests []InlineManifestEntry) error {
+	// position orders an object by its manifest and its place in the manifest
+	type position struct{ manifest, object int }
+	before := func(a, b position) bool {
+		return a.manifest < b.manifest || a.manifest == b.manifest && a.object < b.object
+	}
+
+	size := 0
+	objects := make([][]manifestObject, len(manifests))
+	namespaces := map[string]position{}
+	definitions := map[string]position{}
+	for i, manifest := range manifests {
+		size += len(manifest.Contents)
+
+		parsed, err := parseManifestObjects([]byte(manifest.Contents))
+		if err != nil {
+			return fmt.Errorf("invalid manifest %s: %w", manifest.Name, err)
+		}
+		objects[i] = parsed
+
+		for k, object := range parsed {
+			switch object.Kind {
+			case "Namespace":
+				if _, ok := namespaces[object.Metadata.Name]; !ok {
+					namespaces[object.Metadata.Name] = position{i, k}
+				}
+			case "CustomResourceDefinition":
+				key := object.Spec.Group + "/" + object.Spec.Names.Kind
+				if _, ok := definitions[key]; !ok {
+					definitions[key] = position{i, k}
+				}
+			}
+		}
+	}
+
+	if size > maxInlineManifestsSize {
+		return fmt.Errorf("inline manifests are %d KiB, at most %d KiB fit into the machine config; use extraManifests for large manifests",
+			size>>10, maxInlineManifestsSize>>10)
+	}
+
+	for i, parsed := range objects {
+		for k, object := range parsed {
+			at := position{i, k}
+			namespace := object.Metadata.Namespace
+			if created, ok := namespaces[namespace]; ok && before(at, created) && !builtinNamespaces[namespace] {
+				return fmt.Errorf("manifest %s uses namespace %s before manifest %s creates it", manifests[i].Name, namespace, manifests[created.manifest].Name)
+			}
+			if defined, ok := definitions[object.group()+"/"+object.Kind]; ok && before(at, defined) {
+				return fmt.Errorf("manifest %s uses %s before manifest %s defines it", manifests[i].Name, object.Kind, manifests[defined.manifest].Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package talos
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckInlineManifests(t *testing.T) {
+	const (
+		namespace  = "apiVersion: v1\nkind: Namespace\nmetadata: {name: monitoring}\n"
+		configMap  = "apiVersion: v1\nkind: ConfigMap\nmetadata: {name: a, namespace: monitoring}\n"
+		definition = "apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nmetadata: {name: alerts.example.com}\nspec: {group: example.com, names: {kind: Alert}}\n"
+		alert      = "apiVersion: example.com/v1\nkind: Alert\nmetadata: {name: a, namespace: kube-system}\n"
+	)
+
+	tests := []struct {
+		name      string
+		manifests []InlineManifestEntry
+		err       string
+	}{
+		{
+			name:      "namespace before its objects",
+			manifests: []InlineManifestEntry{{Name: "10-namespace", Contents: namespace}, {Name: "20-config", Contents: configMap}},
+		},
+		{
+			name:      "namespace after its objects",
+			manifests: []InlineManifestEntry{{Name: "10-config", Contents: configMap}, {Name: "20-namespace", Contents: namespace}},
+			err:       "manifest 10-config uses namespace monitoring before manifest 20-namespace creates it",
+		},
+		{
+			name:      "namespace after its objects in one manifest",
+			manifests: []InlineManifestEntry{{Name: "monitoring", Contents: configMap + "---\n" + namespace}},
+			err:       "manifest monitoring uses namespace monitoring before manifest monitoring creates it",
+		},
+		{
+			name:      "namespace before its objects in one manifest",
+			manifests: []InlineManifestEntry{{Name: "monitoring", Contents: namespace + "---\n" + configMap}},
+		},
+		{
+			name:      "builtin namespaces exist",
+			manifests: []InlineManifestEntry{{Name: "10-alert", Contents: "apiVersion: v1\nkind: ConfigMap\nmetadata: {name: a, namespace: kube-system}\n"}, {Name: "20-namespace", Contents: "apiVersion: v1\nkind: Namespace\nmetadata: {name: kube-system}\n"}},
+		},
+		{
+			name:      "definition before its resources",
+			manifests: []InlineManifestEntry{{Name: "10-crd", Contents: definition}, {Name: "20-alert", Contents: alert}},
+		},
+		{
+			name:      "definition after its resources",
+			manifests: []InlineManifestEntry{{Name: "10-alert", Contents: alert}, {Name: "20-crd", Contents: definition}},
+			err:       "manifest 10-alert uses Alert before manifest 20-crd defines it",
+		},
+		{
+			name:      "too large",
+			manifests: []InlineManifestEntry{{Name: "large", Contents: namespace + "# " + strings.Repeat("x", maxInlineManifestsSize)}},
+			err:       "use extraManifests for large manifests",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkInlineManifests(tt.manifests)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("checkInlineManifests: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("checkInlineManifests error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
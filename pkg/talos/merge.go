@@ -0,0 +1,451 @@
+package talos
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// patchDirective is the map key that controls how a map or list item is merged.
+const patchDirective = "$patch"
+
+const (
+	// patchDelete removes the key or list item from the merged config.
+	patchDelete = "delete"
+	// patchReplace replaces the merged value instead of merging into it.
+	patchReplace = "replace"
+)
+
+// listKeys maps the paths of Talos lists whose items are merged by identity to the keys identifying an item.
+// Items of any other list are appended.
+var listKeys = map[string][]string{
+	"machine.network.interfaces":         {"interface", "deviceSelector"},
+	"machine.network.interfaces[].vlans": {"vlanId"},
+	"machine.kernel.modules":             {"name"},
+	"machine.kubelet.extraMounts":        {"destination"},
+	"machine.files":                      {"path"},
+	"machine.disks":                      {"device"},
+	"cluster.inlineManifests":            {"name"},
+}
+
+// mergeConfig merges a patch into a machine config with Talos semantics and returns the result.
+// Maps are merged recursively, lists listed in listKeys merge their items by identity and other
+// lists are appended to. A "$patch: delete" or "$patch: replace" entry deletes or replaces a map or
+// list item, and a "- $patch: replace" item replaces the whole list.
+func mergeConfig(dst, src any) (any, error) {
+	return mergeValue(dst, src, "")
+}
+
+// mergeValue merges src into dst at path.
+func mergeValue(dst, src any, path string) (any, error) {
+	switch s := src.(type) {
+	case map[string]any:
+		directive, rest, err := splitDirective(s, path)
+		if err != nil {
+			return nil, err
+		}
+		switch directive {
+		case patchDelete:
+			return nil, nil
+		case patchReplace:
+			return rest, nil
+		}
+
+		d, ok := dst.(map[string]any)
+		if !ok {
+			return rest, nil
+		}
+		merged := make(map[string]any, len(d)+len(rest))
+		for k, v := range d {
+			merged[k] = v
+		}
+		for k, v := range rest {
+			if isDelete(v) {
+				delete(merged, k)
+				continue
+			}
+			value, err := mergeValue(merged[k], v, joinPath(path, k))
+			if err != nil {
+				return nil, err
+			}
+			merged[k] = value
+		}
+		return merged, nil
+	case []any:
+		d, _ := dst.([]any)
+		if list, ok := replaceList(s); ok {
+			d = nil
+			s = list
+		}
+		if keys, ok := listKeys[path]; ok {
+			return mergeKeyedList(d, s, path, keys)
+		}
+		return appendList(d, s), nil
+	default:
+		return src, nil
+	}
+}
+
+// mergeKeyedList merges the items of src into dst, matching items by the first key they carry.
+func mergeKeyedList(dst, src []any, path string, keys []string) ([]any, error) {
+	merged := append([]any(nil), dst...)
+	for _, item := range src {
+		index := -1
+		if key, id, ok := itemIdentity(item, keys); ok {
+			for i, existing := range merged {
+				if existingKey, existingID, ok := itemIdentity(existing, keys); ok && existingKey == key && reflect.DeepEqual(existingID, id) {
+					index = i
+					break
+				}
+			}
+		}
+
+		if isDelete(item) {
+			if index >= 0 {
+				merged = append(merged[:index], merged[index+1:]...)
+			}
+			continue
+		}
+
+		if index < 0 {
+			value, err := mergeValue(nil, item, path+"[]")
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, value)
+			continue
+		}
+
+		value, err := mergeValue(merged[index], item, path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		merged[index] = value
+	}
+	return merged, nil
+}
+
+// replaceList returns the list without its "$patch: replace" item, or false if it has none.
+func replaceList(list []any) ([]any, bool) {
+	for i, item := range list {
+		if m, ok := item.(map[string]any); ok && len(m) == 1 && m[patchDirective] == patchReplace {
+			return append(append([]any(nil), list[:i]...), list[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+// itemIdentity returns the first of keys an item carries and its value.
+func itemIdentity(item any, keys []string) (string, any, bool) {
+	m, ok := item.(map[string]any)
+	if !ok {
+		return "", nil, false
+	}
+	for _, key := range keys {
+		if id, ok := m[key]; ok {
+			return key, id, true
+		}
+	}
+	return "", nil, false
+}
+
+// appendList appends the items of src to dst, skipping scalar items dst already contains.
+func appendList(dst, src []any) []any {
+	merged := append([]any(nil), dst...)
+	for _, item := range src {
+		if _, isMap := item.(map[string]any); !isMap && containsValue(merged, item) {
+			continue
+		}
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// containsValue returns true if list contains value.
+func containsValue(list []any, value any) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitDirective returns the $patch directive of a map and the map without it.
+func splitDirective(m map[string]any, path string) (string, map[string]any, error) {
+	raw, ok := m[patchDirective]
+	if !ok {
+		return "", m, nil
+	}
+	directive, _ := raw.(string)
+	if directive != patchDelete && directive != patchReplace {
+		return "", nil, fmt.Errorf("%s: unknown %s directive %v", path, patchDirective, raw)
+	}
+
+	rest := make(map[string]any, len(m)-1)
+	for k, v := range m {
+		if k != patchDirective {
+			rest[k] = v
+		}
+	}
+	return directive, rest, nil
+}
+
+// isDelete returns true if v is a map carrying "$patch: delete".
+func isDelete(v any) bool {
+	m, ok := v.(map[string]any)
+	return ok && m[patchDirective] == patchDelete
+}
+
+// joinPath appends key to a dotted config path.
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// jsonPatchOperation is a single RFC 6902 operation.
+type jsonPatchOperation struct {
+	Op    string
+	Path  string
+	From  string
+	Value any
+}
+
+// parseJSONPatch returns the operations of a patch file that is a JSON6902 operation list,
+// or false if the document is not one.
+func parseJSONPatch(doc any) ([]jsonPatchOperation, bool, error) {
+	list, ok := doc.([]any)
+	if !ok {
+		return nil, false, nil
+	}
+
+	operations := make([]jsonPatchOperation, 0, len(list))
+	for i, item := range list {
+		m, ok := item.(map[string]any)
+		if !ok {
+			return nil, true, fmt.Errorf("operation %d is not an object", i)
+		}
+		op, _ := m["op"].(string)
+		path, _ := m["path"].(string)
+		from, _ := m["from"].(string)
+		if op == "" {
+			return nil, true, fmt.Errorf("operation %d has no op", i)
+		}
+		operations = append(operations, jsonPatchOperation{Op: op, Path: path, From: from, Value: m["value"]})
+	}
+	return operations, true, nil
+}
+
+// applyJSONPatch applies RFC 6902 operations to doc.
+func applyJSONPatch(doc any, operations []jsonPatchOperation) (any, error) {
+	var err error
+	for _, operation := range operations {
+		switch operation.Op {
+		case "add":
+			doc, err = setPointer(doc, operation.Path, operation.Value, true)
+		case "replace":
+			doc, err = setPointer(doc, operation.Path, operation.Value, false)
+		case "remove":
+			doc, err = removePointer(doc, operation.Path)
+		case "copy", "move":
+			var value any
+			value, err = getPointer(doc, operation.From)
+			// The copy must not share maps or lists with its source, or later operations would change both
+			value = deepCopy(value)
+			if err == nil && operation.Op == "move" {
+				doc, err = removePointer(doc, operation.From)
+			}
+			if err == nil {
+				doc, err = setPointer(doc, operation.Path, value, true)
+			}
+		case "test":
+			var value any
+			value, err = getPointer(doc, operation.Path)
+			if err == nil && !reflect.DeepEqual(value, operation.Value) {
+				err = fmt.Errorf("value at %s does not match", operation.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", operation.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", operation.Op, operation.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// deepCopy returns a copy of a decoded YAML value that shares no maps or lists with it.
+func deepCopy(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, item := range v {
+			m[k] = deepCopy(item)
+		}
+		return m
+	case []any:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = deepCopy(item)
+		}
+		return list
+	default:
+		return value
+	}
+}
+
+// splitPointer splits a JSON pointer into its unescaped tokens.
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON pointer must start with /")
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// listIndex parses a list index token, allowing "-" for the end of the list when appending.
+func listIndex(token string, length int, appending bool) (int, error) {
+	if token == "-" && appending {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	limit := length
+	if appending {
+		limit++
+	}
+	if err != nil || index < 0 || index >= limit {
+		return 0, fmt.Errorf("invalid list index %q", token)
+	}
+	return index, nil
+}
+
+// getPointer returns the value at pointer.
+func getPointer(doc any, pointer string) (any, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	current := doc
+	for _, token := range tokens {
+		switch c := current.(type) {
+		case map[string]any:
+			value, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("%s does not exist", token)
+			}
+			current = value
+		case []any:
+			index, err := listIndex(token, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			current = c[index]
+		default:
+			return nil, fmt.Errorf("%s does not exist", token)
+		}
+	}
+	return current, nil
+}
+
+// parentPointer returns the pointer of the parent of tokens and the parent value.
+func parentPointer(doc any, tokens []string) (string, any, error) {
+	if len(tokens) == 1 {
+		return "", doc, nil
+	}
+	pointer := "/" + strings.Join(escapeTokens(tokens[:len(tokens)-1]), "/")
+	parent, err := getPointer(doc, pointer)
+	return pointer, parent, err
+}
+
+// setPointer sets the value at pointer. Adding inserts into lists, replacing requires the value to exist.
+func setPointer(doc any, pointer string, value any, adding bool) (any, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPath, parent, err := parentPointer(doc, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]any:
+		if _, ok := p[last]; !ok && !adding {
+			return nil, fmt.Errorf("%s does not exist", last)
+		}
+		p[last] = value
+		return doc, nil
+	case []any:
+		index, err := listIndex(last, len(p), adding)
+		if err != nil {
+			return nil, err
+		}
+		if !adding {
+			p[index] = value
+			return doc, nil
+		}
+		// Inserting grows the list, so the parent is replaced by the new list
+		list := append(append(p[:index:index], value), p[index:]...)
+		return setPointer(doc, parentPath, list, false)
+	default:
+		return nil, fmt.Errorf("parent of %s is not an object or list", last)
+	}
+}
+
+// removePointer removes the value at pointer.
+func removePointer(doc any, pointer string) (any, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+
+	parentPath, parent, err := parentPointer(doc, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+	switch p := parent.(type) {
+	case map[string]any:
+		if _, ok := p[last]; !ok {
+			return nil, fmt.Errorf("%s does not exist", last)
+		}
+		delete(p, last)
+		return doc, nil
+	case []any:
+		index, err := listIndex(last, len(p), false)
+		if err != nil {
+			return nil, err
+		}
+		list := append(p[:index:index], p[index+1:]...)
+		return setPointer(doc, parentPath, list, false)
+	default:
+		return nil, fmt.Errorf("parent of %s is not an object or list", last)
+	}
+}
+
+// escapeTokens escapes tokens for use in a JSON pointer.
+func escapeTokens(tokens []string) []string {
+	escaped := make([]string, len(tokens))
+	for i, token := range tokens {
+		escaped[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+	}
+	return escaped
+}
@@ -0,0 +1,279 @@
+package talos
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// decodeYaml decodes a YAML test fixture the way patch files are decoded.
+func decodeYaml(t *testing.T, content string) any {
+	t.Helper()
+	var value any
+	if err := yaml.Unmarshal([]byte(content), &value); err != nil {
+		t.Fatalf("decoding %q: %v", content, err)
+	}
+	return convertKeysToString(value)
+}
+
+func TestMergeConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		dst   string
+		patch string
+		want  string
+	}{
+		{
+			name:  "maps merge recursively",
+			dst:   "machine: {type: worker, kubelet: {image: a}}",
+			patch: "machine: {kubelet: {extraArgs: {v: '2'}}}",
+			want:  "machine: {type: worker, kubelet: {image: a, extraArgs: {v: '2'}}}",
+		},
+		{
+			name:  "scalars are replaced",
+			dst:   "machine: {type: worker}",
+			patch: "machine: {type: controlplane}",
+			want:  "machine: {type: controlplane}",
+		},
+		{
+			name:  "delete removes a key",
+			dst:   "machine: {type: worker, kubelet: {image: a}}",
+			patch: "machine: {kubelet: {$patch: delete}}",
+			want:  "machine: {type: worker}",
+		},
+		{
+			name:  "replace replaces a map",
+			dst:   "machine: {kubelet: {image: a, extraArgs: {v: '2'}}}",
+			patch: "machine: {kubelet: {$patch: replace, image: b}}",
+			want:  "machine: {kubelet: {image: b}}",
+		},
+		{
+			name:  "unkeyed lists are appended without duplicate scalars",
+			dst:   "cluster: {apiServer: {certSANs: [a, b]}}",
+			patch: "cluster: {apiServer: {certSANs: [b, c]}}",
+			want:  "cluster: {apiServer: {certSANs: [a, b, c]}}",
+		},
+		{
+			name:  "replace item replaces a list",
+			dst:   "cluster: {apiServer: {certSANs: [a, b]}}",
+			patch: "cluster: {apiServer: {certSANs: [{$patch: replace}, c]}}",
+			want:  "cluster: {apiServer: {certSANs: [c]}}",
+		},
+		{
+			name:  "keyed list items merge by identity",
+			dst:   "machine: {network: {interfaces: [{interface: eth0, dhcp: true}, {interface: eth1, mtu: 1500}]}}",
+			patch: "machine: {network: {interfaces: [{interface: eth1, mtu: 9000}, {interface: eth2}]}}",
+			want:  "machine: {network: {interfaces: [{interface: eth0, dhcp: true}, {interface: eth1, mtu: 9000}, {interface: eth2}]}}",
+		},
+		{
+			name:  "keyed list items merge by their first identity key",
+			dst:   "machine: {network: {interfaces: [{deviceSelector: {busPath: '0*'}, dhcp: true}]}}",
+			patch: "machine: {network: {interfaces: [{deviceSelector: {busPath: '0*'}, vip: {ip: 10.0.0.1}}]}}",
+			want:  "machine: {network: {interfaces: [{deviceSelector: {busPath: '0*'}, dhcp: true, vip: {ip: 10.0.0.1}}]}}",
+		},
+		{
+			name:  "nested keyed lists merge by identity",
+			dst:   "machine: {network: {interfaces: [{interface: eth0, vlans: [{vlanId: 10, mtu: 1500}]}]}}",
+			patch: "machine: {network: {interfaces: [{interface: eth0, vlans: [{vlanId: 10, mtu: 9000}, {vlanId: 20}]}]}}",
+			want:  "machine: {network: {interfaces: [{interface: eth0, vlans: [{vlanId: 10, mtu: 9000}, {vlanId: 20}]}]}}",
+		},
+		{
+			name:  "delete removes a keyed list item",
+			dst:   "cluster: {inlineManifests: [{name: a, contents: x}, {name: b, contents: y}]}",
+			patch: "cluster: {inlineManifests: [{name: a, $patch: delete}]}",
+			want:  "cluster: {inlineManifests: [{name: b, contents: y}]}",
+		},
+		{
+			name:  "replace replaces a keyed list item",
+			dst:   "machine: {files: [{path: /a, content: x, permissions: 420}]}",
+			patch: "machine: {files: [{path: /a, content: y, $patch: replace}]}",
+			want:  "machine: {files: [{path: /a, content: y}]}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeConfig(decodeYaml(t, tt.dst), decodeYaml(t, tt.patch))
+			if err != nil {
+				t.Fatalf("mergeConfig: %v", err)
+			}
+			if want := decodeYaml(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("mergeConfig = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMergeConfigUnknownDirective(t *testing.T) {
+	_, err := mergeConfig(decodeYaml(t, "machine: {}"), decodeYaml(t, "machine: {$patch: merge}"))
+	if err == nil || !strings.Contains(err.Error(), "unknown $patch directive") {
+		t.Errorf("mergeConfig error = %v, want an unknown directive error", err)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		err   string
+	}{
+		{
+			name:  "add sets a map key",
+			doc:   "machine: {type: worker}",
+			patch: "[{op: add, path: /machine/kubelet, value: {image: a}}]",
+			want:  "machine: {type: worker, kubelet: {image: a}}",
+		},
+		{
+			name:  "add inserts into a list",
+			doc:   "sans: [a, c]",
+			patch: "[{op: add, path: /sans/1, value: b}]",
+			want:  "sans: [a, b, c]",
+		},
+		{
+			name:  "add appends to a list",
+			doc:   "sans: [a]",
+			patch: "[{op: add, path: /sans/-, value: b}]",
+			want:  "sans: [a, b]",
+		},
+		{
+			name:  "add unescapes pointer tokens",
+			doc:   "labels: {}",
+			patch: "[{op: add, path: /labels/example.com~1role, value: db}]",
+			want:  "labels: {example.com/role: db}",
+		},
+		{
+			name:  "replace changes an existing value",
+			doc:   "machine: {type: worker}",
+			patch: "[{op: replace, path: /machine/type, value: controlplane}]",
+			want:  "machine: {type: controlplane}",
+		},
+		{
+			name:  "replace requires the value to exist",
+			doc:   "machine: {}",
+			patch: "[{op: replace, path: /machine/type, value: controlplane}]",
+			err:   "type does not exist",
+		},
+		{
+			name:  "remove deletes a map key",
+			doc:   "machine: {type: worker, kubelet: {image: a}}",
+			patch: "[{op: remove, path: /machine/kubelet}]",
+			want:  "machine: {type: worker}",
+		},
+		{
+			name:  "remove deletes a list item",
+			doc:   "sans: [a, b, c]",
+			patch: "[{op: remove, path: /sans/1}]",
+			want:  "sans: [a, c]",
+		},
+		{
+			name:  "remove rejects an index past the end",
+			doc:   "sans: [a]",
+			patch: "[{op: remove, path: /sans/1}]",
+			err:   "invalid list index",
+		},
+		{
+			name:  "copy duplicates a value",
+			doc:   "a: {x: 1}",
+			patch: "[{op: copy, from: /a, path: /b}]",
+			want:  "{a: {x: 1}, b: {x: 1}}",
+		},
+		{
+			name:  "copy does not share the copied value",
+			doc:   "a: {x: 1, list: [1]}",
+			patch: "[{op: copy, from: /a, path: /b}, {op: replace, path: /b/x, value: 2}, {op: add, path: /b/list/-, value: 2}]",
+			want:  "{a: {x: 1, list: [1]}, b: {x: 2, list: [1, 2]}}",
+		},
+		{
+			name:  "move relocates a value",
+			doc:   "a: {x: 1}",
+			patch: "[{op: move, from: /a, path: /b}]",
+			want:  "b: {x: 1}",
+		},
+		{
+			name:  "move relocates a list item",
+			doc:   "sans: [a, b, c]",
+			patch: "[{op: move, from: /sans/0, path: /sans/-}]",
+			want:  "sans: [b, c, a]",
+		},
+		{
+			name:  "test passes on an equal value",
+			doc:   "machine: {type: worker}",
+			patch: "[{op: test, path: /machine/type, value: worker}, {op: replace, path: /machine/type, value: controlplane}]",
+			want:  "machine: {type: controlplane}",
+		},
+		{
+			name:  "test fails on a different value",
+			doc:   "machine: {type: worker}",
+			patch: "[{op: test, path: /machine/type, value: controlplane}]",
+			err:   "does not match",
+		},
+		{
+			name:  "unknown ops are rejected",
+			doc:   "machine: {}",
+			patch: "[{op: merge, path: /machine}]",
+			err:   `unknown op "merge"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operations, ok, err := parseJSONPatch(decodeYaml(t, tt.patch))
+			if err != nil || !ok {
+				t.Fatalf("parseJSONPatch = %v, %v", ok, err)
+			}
+
+			got, err := applyJSONPatch(decodeYaml(t, tt.doc), operations)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("applyJSONPatch error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("applyJSONPatch: %v", err)
+			}
+			if want := decodeYaml(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("applyJSONPatch = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseJSONPatch(t *testing.T) {
+	if _, ok, err := parseJSONPatch(decodeYaml(t, "machine: {}")); ok || err != nil {
+		t.Errorf("parseJSONPatch of a map = %v, %v, want no JSON patch", ok, err)
+	}
+	if _, ok, err := parseJSONPatch(decodeYaml(t, "[{path: /machine}]")); !ok || err == nil {
+		t.Errorf("parseJSONPatch without op = %v, %v, want an error", ok, err)
+	}
+}
+
+func TestPatchesGeneratedConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    bool
+	}{
+		{name: "plain patch", content: "machine: {network: {hostname: a}}", want: false},
+		{name: "delete directive", content: "machine: {network: {kubespan: {$patch: delete}}}", want: true},
+		{name: "replace directive in a list", content: "cluster: {apiServer: {certSANs: [{$patch: replace}, a]}}", want: true},
+		{name: "JSON6902 operations", content: "[{op: remove, path: /cluster/proxy}]", want: true},
+		{name: "directive in a later document", content: "machine: {}\n---\napiVersion: v1alpha1\nkind: Layer2VIPConfig\nname: 10.0.0.1\n$patch: delete", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := patchesGeneratedConfig([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("patchesGeneratedConfig: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("patchesGeneratedConfig = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package talos
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// StaticAddressPatch represents the static address configuration of the node interface.
+type StaticAddressPatch struct {
+	Machine struct {
+		Network struct {
+			Nameservers []string          `json:"nameservers,omitempty"`
+			Interfaces  []StaticInterface `json:"interfaces"`
+		} `json:"network"`
+	} `json:"machine"`
+}
+
+// StaticInterface represents a Talos network interface with a static address.
+type StaticInterface struct {
+	DeviceSelector map[string]string `json:"deviceSelector"`
+	DHCP           bool              `json:"dhcp"`
+	Addresses      []string          `json:"addresses"`
+	Routes         []Route           `json:"routes"`
+}
+
+// Route represents a Talos interface route.
+type Route struct {
+	Network string `json:"network"`
+	Gateway string `json:"gateway"`
+}
+
+// DefaultDeviceSelector selects the first PCI network device, matching the talos-config templates.
+var DefaultDeviceSelector = map[string]string{"busPath": "0*"}
+
+// NewStaticAddressPatch creates a JSON patch that gives the node interface matched by selector,
+// or the default interface if selector is empty, a static address with a default route through gateway.
+func NewStaticAddressPatch(address, gateway string, nameservers []string, selector map[string]string) ([]byte, error) {
+	if len(selector) == 0 {
+		selector = DefaultDeviceSelector
+	}
+
+	patch := StaticAddressPatch{}
+	patch.Machine.Network.Nameservers = nameservers
+	patch.Machine.Network.Interfaces = []StaticInterface{
+		{
+			DeviceSelector: selector,
+			DHCP:           false,
+			Addresses:      []string{address},
+			Routes:         []Route{{Network: "0.0.0.0/0", Gateway: gateway}},
+		},
+	}
+	return json.Marshal(patch)
+}
+
+// checkInterfaceSelector checks that the patches configure no interface by another device selector
+// than selector. The VMs have a single network device, so an interface entry with another selector
+// matches the same device as the generated entry and the two conflict.
+func checkInterfaceSelector(patches [][]byte, selector map[string]string) error {
+	want := make(map[string]any, len(selector))
+	for k, v := range selector {
+		want[k] = v
+	}
+
+	for _, patch := range patches {
+		var config struct {
+			Machine struct {
+				Network struct {
+					Interfaces []struct {
+						DeviceSelector map[string]any `json:"deviceSelector"`
+					} `json:"interfaces"`
+				} `json:"network"`
+			} `json:"machine"`
+		}
+		if err := json.Unmarshal(patch, &config); err != nil {
+			// Documents other than the v1alpha1 config have no interfaces
+			continue
+		}
+		for _, iface := range config.Machine.Network.Interfaces {
+			if iface.DeviceSelector != nil && !reflect.DeepEqual(iface.DeviceSelector, want) {
+				return fmt.Errorf("talos-config selects the interface by %v, but the generated interface is selected by %v; "+
+					"the VMs have a single network device, so both must use the same deviceSelector", iface.DeviceSelector, selector)
+			}
+		}
+	}
+	return nil
+}
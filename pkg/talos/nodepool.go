@@ -0,0 +1,33 @@
+package talos
+
+import (
+	"encoding/json"
+
+	"proxmox-talos/internal/types"
+)
+
+// NodePoolPatch represents the node labels and taints of a node pool.
+type NodePoolPatch struct {
+	Machine struct {
+		NodeLabels map[string]string `json:"nodeLabels,omitempty"`
+		NodeTaints map[string]string `json:"nodeTaints,omitempty"`
+	} `json:"machine"`
+}
+
+// NewNodePoolPatch creates a JSON patch for the labels and taints of a node pool.
+// It returns nil if the pool has neither.
+func NewNodePoolPatch(pool *types.NodePool) ([]byte, error) {
+	if pool == nil || (len(pool.Labels) == 0 && len(pool.Taints) == 0) {
+		return nil, nil
+	}
+
+	patch := NodePoolPatch{}
+	patch.Machine.NodeLabels = pool.Labels
+	if len(pool.Taints) > 0 {
+		patch.Machine.NodeTaints = make(map[string]string, len(pool.Taints))
+		for _, taint := range pool.Taints {
+			patch.Machine.NodeTaints[taint.Key] = taint.String()
+		}
+	}
+	return json.Marshal(patch)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/TwiN/deepmerge"
 	"gopkg.in/yaml.v3"
 )
 
@@ -29,6 +28,10 @@ func convertKeysToString(i any) any {
 			m2[fmt.Sprint(k)] = convertKeysToString(v)
 		}
 		return m2
+	case map[string]any:
+		for k, v := range x {
+			x[k] = convertKeysToString(v)
+		}
 	case []any:
 		for i, v := range x {
 			x[i] = convertKeysToString(v)
@@ -37,23 +40,130 @@ func convertKeysToString(i any) any {
 	return i
 }
 
+// MergeYaml merges the YAML patch files in order with Talos semantics and returns the merged YAML.
+// Files may hold several documents: documents of the same kind and name are merged and the result
+// holds the v1alpha1 config first, followed by the other documents ordered by kind and name.
+// A document patched with "$patch: delete" is left out.
+// A document holding a list is applied as JSON6902 operations to the v1alpha1 config merged so far.
 func MergeYaml(files ...string) (string, error) {
 	if len(files) == 0 {
 		return "", fmt.Errorf("no YAML files provided for merging")
 	}
 
-	var merged []byte
-	for _, file := range files {
+	sources := make([]patchSource, len(files))
+	for i, file := range files {
 		content, err := os.ReadFile(file)
 		if err != nil {
 			return "", fmt.Errorf("failed to read file %s: %w", file, err)
 		}
+		sources[i] = patchSource{Name: file, Content: content}
+	}
+	return mergeSources(sources)
+}
 
-		merged, err = deepmerge.YAML(merged, content)
+// patchSource is the content of a patch file.
+type patchSource struct {
+	Name    string
+	Content []byte
+}
+
+// mergeSources merges patch contents in order the way MergeYaml merges files.
+func mergeSources(sources []patchSource) (string, error) {
+	var merged []document
+	index := map[string]int{}
+	for _, source := range sources {
+		documents, err := parseDocuments(source.Content)
 		if err != nil {
-			return "", fmt.Errorf("failed to merge file %s: %w", file, err)
+			return "", fmt.Errorf("failed to parse file %s: %w", source.Name, err)
+		}
+
+		for _, doc := range documents {
+			i, ok := index[doc.key()]
+			if !ok {
+				i = len(merged)
+				index[doc.key()] = i
+				merged = append(merged, document{Kind: doc.Kind, Name: doc.Name})
+			}
+
+			operations, isJSONPatch, err := parseJSONPatch(doc.Body)
+			if err != nil {
+				return "", fmt.Errorf("failed to parse JSON patch %s: %w", source.Name, err)
+			}
+			if isJSONPatch {
+				merged[i].Body, err = applyJSONPatch(merged[i].Body, operations)
+			} else {
+				merged[i].Body, err = mergeConfig(merged[i].Body, doc.Body)
+			}
+			if err != nil {
+				return "", fmt.Errorf("failed to merge file %s: %w", source.Name, err)
+			}
+		}
+	}
+
+	// A document removed by "$patch: delete" has no body left and is dropped rather than rendered as null
+	kept := merged[:0]
+	for _, doc := range merged {
+		if doc.Body != nil {
+			kept = append(kept, doc)
 		}
 	}
 
-	return string(merged), nil
+	sortDocuments(kept)
+	return marshalDocuments(kept)
+}
+
+// SplitPatches converts a multi-document YAML config into one JSON config patch per document.
+func SplitPatches(content []byte) ([][]byte, error) {
+	documents, err := parseDocuments(content)
+	if err != nil {
+		return nil, err
+	}
+	sortDocuments(documents)
+
+	patches := make([][]byte, 0, len(documents))
+	for _, doc := range documents {
+		patch, err := json.Marshal(doc.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert %s document to JSON: %w", doc.key(), err)
+		}
+		patches = append(patches, patch)
+	}
+	return patches, nil
+}
+
+// patchesGeneratedConfig returns true if content holds JSON6902 operations or $patch directives,
+// which must reach Talos unmerged to delete or replace values of the config it generates.
+func patchesGeneratedConfig(content []byte) (bool, error) {
+	documents, err := parseDocuments(content)
+	if err != nil {
+		return false, err
+	}
+	for _, doc := range documents {
+		if _, ok := doc.Body.([]any); ok || hasDirective(doc.Body) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hasDirective returns true if a $patch directive appears anywhere in value.
+func hasDirective(value any) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		if _, ok := v[patchDirective]; ok {
+			return true
+		}
+		for _, item := range v {
+			if hasDirective(item) {
+				return true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if hasDirective(item) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -0,0 +1,124 @@
+package talos
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/machine"
+	"proxmox-talos/internal/config"
+	"proxmox-talos/internal/file"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// MachineSecretsOutput is the stack output holding the machine secrets bundle, which render mode reuses.
+const MachineSecretsOutput = "TalosMachineSecrets"
+
+// Renderer writes the machine config of every node to disk instead of applying it.
+type Renderer struct {
+	ctx     *pulumi.Context
+	cluster *talosCluster.Cluster
+	config  *config.ClusterConfig
+	// secrets of the deployed cluster
+	secrets *machine.MachineSecrets
+	// schematicIDs holds the image factory ID of every registered schematic, keyed by SchematicDigest
+	schematicIDs      map[string]string
+	kubernetesVersion string
+}
+
+// NewRenderer creates a Renderer for a cluster that was deployed before, since the machine config
+// needs its secrets and the installer images need the factory IDs of its schematics.
+func NewRenderer(ctx *pulumi.Context, cluster *talosCluster.Cluster, cfg *config.ClusterConfig, secrets *machine.MachineSecrets, schematicIDs map[string]string) (*Renderer, error) {
+	if secrets == nil {
+		return nil, fmt.Errorf("no machine secrets deployed yet, run pulumi up once before rendering")
+	}
+	return &Renderer{
+		ctx:               ctx,
+		cluster:           cluster,
+		config:            cfg,
+		secrets:           secrets,
+		schematicIDs:      schematicIDs,
+		kubernetesVersion: cluster.KubernetesVersion,
+	}, nil
+}
+
+// SetKubernetesVersion sets the Kubernetes version the machine config is rendered for.
+func (r *Renderer) SetKubernetesVersion(version string) {
+	r.kubernetesVersion = version
+}
+
+// installer returns the installer image of a schematic. The factory assigns the schematic ID when
+// the schematic is registered, so a schematic that was added or changed since the last deployment fails.
+func (r *Renderer) installer(name string) (string, error) {
+	schematic := r.config.Schematics[name]
+	content, err := NewSchematic(&schematic)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal schematic %s: %w", name, err)
+	}
+	id, ok := r.schematicIDs[SchematicDigest(content)]
+	if !ok {
+		return "", fmt.Errorf("schematic %s is not registered with the image factory, run pulumi up before rendering", name)
+	}
+	return InstallerImage(id, r.cluster.TalosVersion), nil
+}
+
+// Render writes the fully patched machine config of every node to <node>.yaml in dir.
+func (r *Renderer) Render(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating %s: %w", dir, err)
+	}
+
+	manifests, err := ClusterManifests(r.ctx, r.config, r.cluster)
+	if err != nil {
+		return fmt.Errorf("rendering inline manifests: %w", err)
+	}
+
+	var rendered pulumi.StringArray
+	for _, node := range r.cluster.Nodes {
+		files, err := PatchFiles(r.config, node)
+		if err != nil {
+			return err
+		}
+		r.ctx.Log.Info(fmt.Sprintf("Node %s uses patch files %s", node.Name(), strings.Join(files, ", ")), nil)
+
+		installer, err := r.installer(node.Pool().Schematic)
+		if err != nil {
+			return fmt.Errorf("rendering node %s: %w", node.Name(), err)
+		}
+
+		patches, err := NodeConfigPatches(r.config, r.cluster, node, files, pulumi.String(installer), manifests)
+		if err != nil {
+			return fmt.Errorf("rendering patches for node %s: %w", node.Name(), err)
+		}
+
+		content := machine.GetConfigurationOutput(r.ctx, machine.GetConfigurationOutputArgs{
+			ClusterName:       pulumi.String(r.cluster.Name),
+			MachineType:       pulumi.String(node.Type().String()),
+			ClusterEndpoint:   pulumi.String(r.cluster.KubernetesAPI),
+			TalosVersion:      pulumi.String(r.cluster.TalosVersion),
+			KubernetesVersion: pulumi.String(r.kubernetesVersion),
+			Docs:              pulumi.Bool(false),
+			Examples:          pulumi.Bool(false),
+			MachineSecrets:    pulumi.ToOutput(*r.secrets).(machine.MachineSecretsOutput),
+			ConfigPatches:     patches,
+		}).MachineConfiguration()
+
+		path := filepath.Join(dir, node.Name()+".yaml")
+		rendered = append(rendered, content.ApplyT(func(content string) (string, error) {
+			if err := ValidateConfig(path, []byte(content), r.cluster.TalosVersion); err != nil {
+				return "", fmt.Errorf("invalid machine config:\n%w", err)
+			}
+			if err := file.WriteToFile(path, content); err != nil {
+				return "", fmt.Errorf("writing %s: %w", path, err)
+			}
+			r.ctx.Log.Info(fmt.Sprintf("Rendered machine config to %s", path), nil)
+			return path, nil
+		}).(pulumi.StringOutput))
+	}
+
+	// Exporting the files keeps the program running until all of them are written
+	r.ctx.Export("RenderedConfigs", rendered)
+	return nil
+}
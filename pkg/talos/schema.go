@@ -0,0 +1,324 @@
+package talos
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// fieldKind is the YAML type a config field expects.
+type fieldKind int
+
+const (
+	kindAny fieldKind = iota
+	kindString
+	kindBool
+	kindInt
+	kindList
+	kindObject
+	kindMap
+)
+
+// String returns the kind as used in validation errors.
+func (k fieldKind) String() string {
+	switch k {
+	case kindString:
+		return "string"
+	case kindBool:
+		return "bool"
+	case kindInt:
+		return "integer"
+	case kindList:
+		return "list"
+	case kindObject, kindMap:
+		return "object"
+	default:
+		return "any"
+	}
+}
+
+// schemaField describes a field of the v1alpha1 machine config.
+type schemaField struct {
+	Kind fieldKind
+	// Fields are the known fields of an object; other fields are rejected.
+	Fields map[string]*schemaField
+	// Elem describes the items of a list or the values of a map.
+	Elem *schemaField
+	// Check validates a scalar value.
+	Check func(string) error
+	// Since is the first Talos minor release of v1 that knows the field.
+	Since int
+}
+
+// since returns a copy of the field that requires Talos v1.<minor>.
+func (f *schemaField) since(minor int) *schemaField {
+	c := *f
+	c.Since = minor
+	return &c
+}
+
+// str returns a string field.
+func str() *schemaField { return &schemaField{Kind: kindString} }
+
+// boolean returns a bool field.
+func boolean() *schemaField { return &schemaField{Kind: kindBool} }
+
+// integer returns an integer field.
+func integer() *schemaField { return &schemaField{Kind: kindInt} }
+
+// anything returns a field that is not validated.
+func anything() *schemaField { return &schemaField{Kind: kindAny} }
+
+// list returns a list field with items described by elem.
+func list(elem *schemaField) *schemaField { return &schemaField{Kind: kindList, Elem: elem} }
+
+// mapOf returns an object field with arbitrary keys and values described by elem.
+func mapOf(elem *schemaField) *schemaField { return &schemaField{Kind: kindMap, Elem: elem} }
+
+// object returns an object field with the given known fields.
+func object(fields map[string]*schemaField) *schemaField {
+	return &schemaField{Kind: kindObject, Fields: fields}
+}
+
+// checked returns a string field validated by check.
+func checked(check func(string) error) *schemaField {
+	return &schemaField{Kind: kindString, Check: check}
+}
+
+// checkIP validates an IP address.
+func checkIP(s string) error {
+	if _, err := netip.ParseAddr(s); err != nil {
+		return fmt.Errorf("invalid IP address %q", s)
+	}
+	return nil
+}
+
+// checkCIDR validates a CIDR, optionally negated with "!" as Talos allows for subnet filters.
+func checkCIDR(s string) error {
+	if _, err := netip.ParsePrefix(strings.TrimPrefix(s, "!")); err != nil {
+		return fmt.Errorf("invalid CIDR %q", s)
+	}
+	return nil
+}
+
+// image returns a container image field.
+func image() *schemaField { return str() }
+
+// extraArgs returns a map of command line arguments.
+func extraArgs() *schemaField { return mapOf(anything()) }
+
+// kubernetesComponent returns the common fields of a Kubernetes control plane component.
+func kubernetesComponent(extra map[string]*schemaField) *schemaField {
+	fields := map[string]*schemaField{
+		"image":         image(),
+		"extraArgs":     extraArgs(),
+		"extraVolumes":  list(anything()),
+		"env":           mapOf(str()),
+		"resources":     anything(),
+		"disabled":      boolean(),
+		"configDisable": boolean(),
+	}
+	for name, field := range extra {
+		fields[name] = field
+	}
+	return object(fields)
+}
+
+// routeSchema describes an interface route.
+var routeSchema = object(map[string]*schemaField{
+	"network": checked(checkCIDR),
+	"gateway": checked(checkIP),
+	"source":  checked(checkIP),
+	"metric":  integer(),
+	"mtu":     integer(),
+})
+
+// deviceSelectorSchema describes how Talos selects a network device.
+var deviceSelectorSchema = object(map[string]*schemaField{
+	"busPath":       str(),
+	"hardwareAddr":  str(),
+	"permanentAddr": str(),
+	"pciID":         str(),
+	"driver":        str(),
+	"physical":      boolean(),
+})
+
+// vipSchema describes a shared virtual IP.
+var vipSchema = object(map[string]*schemaField{
+	"ip":           checked(checkIP),
+	"equinixMetal": anything(),
+	"hcloud":       anything(),
+})
+
+// interfaceSchema describes a machine network interface.
+var interfaceSchema = object(map[string]*schemaField{
+	"interface":      str(),
+	"deviceSelector": deviceSelectorSchema,
+	"addresses":      list(checked(checkCIDR)),
+	"routes":         list(routeSchema),
+	"bond":           anything(),
+	"bridge":         anything(),
+	"vlans": list(object(map[string]*schemaField{
+		"vlanId":      integer(),
+		"addresses":   list(checked(checkCIDR)),
+		"routes":      list(routeSchema),
+		"dhcp":        boolean(),
+		"dhcpOptions": anything(),
+		"mtu":         integer(),
+		"vip":         vipSchema,
+	})),
+	"mtu":         integer(),
+	"dhcp":        boolean(),
+	"dhcpOptions": anything(),
+	"ignore":      boolean(),
+	"dummy":       boolean(),
+	"wireguard":   anything(),
+	"vip":         vipSchema,
+})
+
+// machineConfigSchema describes the v1alpha1 machine config document. Fields added after Talos v1.0
+// carry the minor release that introduced them, so they are rejected for an older TalosVersion.
+var machineConfigSchema = object(map[string]*schemaField{
+	"version": str(),
+	"debug":   boolean(),
+	"persist": boolean(),
+	"machine": object(map[string]*schemaField{
+		"type":         str(),
+		"token":        str(),
+		"ca":           anything(),
+		"acceptedCAs":  list(anything()),
+		"certSANs":     list(str()),
+		"controlPlane": anything(),
+		"kubelet": object(map[string]*schemaField{
+			"image":                               image(),
+			"clusterDNS":                          list(checked(checkIP)),
+			"extraArgs":                           extraArgs(),
+			"extraMounts":                         list(object(map[string]*schemaField{"destination": str(), "type": str(), "source": str(), "options": list(str()), "uidMappings": list(anything()), "gidMappings": list(anything())})),
+			"extraConfig":                         mapOf(anything()),
+			"credentialProviderConfig":            anything(),
+			"defaultRuntimeSeccompProfileEnabled": boolean(),
+			"registerWithFQDN":                    boolean(),
+			"nodeIP":                              object(map[string]*schemaField{"validSubnets": list(checked(checkCIDR))}),
+			"skipNodeRegistration":                boolean(),
+			"disableManifestsDirectory":           boolean(),
+		}),
+		"pods": list(anything()),
+		"network": object(map[string]*schemaField{
+			"hostname":      str(),
+			"interfaces":    list(interfaceSchema),
+			"nameservers":   list(checked(checkIP)),
+			"searchDomains": list(str()),
+			"extraHostEntries": list(object(map[string]*schemaField{
+				"ip":      checked(checkIP),
+				"aliases": list(str()),
+			})),
+			"kubespan": object(map[string]*schemaField{
+				"enabled":                     boolean(),
+				"advertiseKubernetesNetworks": boolean(),
+				"allowDownPeerBypass":         boolean(),
+				"harvestExtraEndpoints":       boolean(),
+				"mtu":                         integer(),
+				"filters":                     anything(),
+			}),
+			"disableSearchDomain": boolean(),
+		}),
+		"disks": list(object(map[string]*schemaField{"device": str(), "partitions": list(anything())})),
+		"install": object(map[string]*schemaField{
+			"disk":              str(),
+			"diskSelector":      anything(),
+			"extraKernelArgs":   list(str()),
+			"image":             image(),
+			"extensions":        list(anything()),
+			"wipe":              boolean(),
+			"legacyBIOSSupport": boolean(),
+			"grubUseUKICmdline": boolean().since(10),
+		}),
+		"files": list(object(map[string]*schemaField{
+			"content":     str(),
+			"permissions": integer(),
+			"path":        str(),
+			"op":          str(),
+		})),
+		"env":                  mapOf(str()),
+		"time":                 object(map[string]*schemaField{"disabled": boolean(), "servers": list(str()), "bootTimeout": str()}),
+		"sysctls":              mapOf(str()),
+		"sysfs":                mapOf(str()),
+		"registries":           anything(),
+		"systemDiskEncryption": anything(),
+		"features": object(map[string]*schemaField{
+			"rbac":                     boolean(),
+			"stableHostname":           boolean(),
+			"kubernetesTalosAPIAccess": object(map[string]*schemaField{"enabled": boolean(), "allowedRoles": list(str()), "allowedKubernetesNamespaces": list(str())}),
+			"apidCheckExtKeyUsage":     boolean(),
+			"diskQuotaSupport":         boolean(),
+			"kubePrism":                object(map[string]*schemaField{"enabled": boolean(), "port": integer()}).since(5),
+			"hostDNS":                  object(map[string]*schemaField{"enabled": boolean(), "forwardKubeDNSToHost": boolean(), "resolveMemberNames": boolean()}).since(7),
+			"imageCache":               object(map[string]*schemaField{"localEnabled": boolean()}).since(10),
+			"nodeAddressSortAlgorithm": str().since(9),
+		}),
+		"udev":                     object(map[string]*schemaField{"rules": list(str())}),
+		"logging":                  anything(),
+		"kernel":                   object(map[string]*schemaField{"modules": list(object(map[string]*schemaField{"name": str(), "parameters": list(str())}))}),
+		"seccompProfiles":          list(object(map[string]*schemaField{"name": str(), "value": anything()})),
+		"nodeLabels":               mapOf(str()),
+		"nodeAnnotations":          mapOf(str()),
+		"nodeTaints":               mapOf(str()),
+		"baseRuntimeSpecOverrides": anything(),
+	}),
+	"cluster": object(map[string]*schemaField{
+		"id":     str(),
+		"secret": str(),
+		"controlPlane": object(map[string]*schemaField{
+			"endpoint":           str(),
+			"localAPIServerPort": integer(),
+		}),
+		"clusterName": str(),
+		"network": object(map[string]*schemaField{
+			"cni":            object(map[string]*schemaField{"name": str(), "urls": list(str()), "flannel": anything()}),
+			"dnsDomain":      str(),
+			"podSubnets":     list(checked(checkCIDR)),
+			"serviceSubnets": list(checked(checkCIDR)),
+		}),
+		"token":                     str(),
+		"aescbcEncryptionSecret":    str(),
+		"secretboxEncryptionSecret": str(),
+		"ca":                        anything(),
+		"aggregatorCA":              anything(),
+		"serviceAccount":            anything(),
+		"apiServer": kubernetesComponent(map[string]*schemaField{
+			"certSANs":                 list(str()),
+			"disablePodSecurityPolicy": boolean(),
+			"admissionControl":         list(anything()),
+			"auditPolicy":              anything(),
+			"authorizationConfig":      list(anything()),
+		}),
+		"controllerManager": kubernetesComponent(nil),
+		"proxy": kubernetesComponent(map[string]*schemaField{
+			"mode": str(),
+		}),
+		"scheduler": kubernetesComponent(map[string]*schemaField{
+			"config": anything(),
+		}),
+		"discovery": object(map[string]*schemaField{
+			"enabled": boolean(),
+			"registries": object(map[string]*schemaField{
+				"kubernetes": object(map[string]*schemaField{"disabled": boolean()}),
+				"service":    object(map[string]*schemaField{"disabled": boolean(), "endpoint": str()}),
+			}),
+		}),
+		"etcd": object(map[string]*schemaField{
+			"image":             image(),
+			"ca":                anything(),
+			"extraArgs":         extraArgs(),
+			"advertisedSubnets": list(checked(checkCIDR)),
+			"listenSubnets":     list(checked(checkCIDR)),
+		}),
+		"coreDNS":                        object(map[string]*schemaField{"disabled": boolean(), "image": image()}),
+		"externalCloudProvider":          object(map[string]*schemaField{"enabled": boolean(), "manifests": list(str())}),
+		"extraManifests":                 list(str()),
+		"extraManifestHeaders":           mapOf(str()),
+		"inlineManifests":                list(object(map[string]*schemaField{"name": str(), "contents": str()})),
+		"adminKubeconfig":                object(map[string]*schemaField{"certLifetime": str()}),
+		"allowSchedulingOnControlPlanes": boolean(),
+	}),
+})
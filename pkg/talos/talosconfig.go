@@ -0,0 +1,66 @@
+package talos
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumiverse/pulumi-talos/sdk/go/talos/client"
+	"proxmox-talos/internal/file"
+	"proxmox-talos/internal/types"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// TalosConfig returns the talosctl client configuration of the cluster with every
+// control plane as endpoint and every node as node.
+func TalosConfig(ctx *pulumi.Context, c *talosCluster.Cluster) pulumi.StringOutput {
+	return talosConfig(ctx, c, nil)
+}
+
+// talosConfig returns the talosctl client configuration with extra endpoints after the control planes.
+func talosConfig(ctx *pulumi.Context, c *talosCluster.Cluster, extraEndpoints []string) pulumi.StringOutput {
+	var endpoints, nodes pulumi.StringArray
+	for _, node := range c.Nodes {
+		nodes = append(nodes, node.IP())
+		if node.Type() == types.ControlPlane {
+			endpoints = append(endpoints, node.IP())
+		}
+	}
+
+	for _, endpoint := range extraEndpoints {
+		endpoints = append(endpoints, pulumi.String(endpoint))
+	}
+
+	clientConfig := c.MachineSecrets.ClientConfiguration
+	return client.GetConfigurationOutput(ctx, client.GetConfigurationOutputArgs{
+		ClusterName: pulumi.String(c.Name),
+		ClientConfiguration: client.GetConfigurationClientConfigurationArgs{
+			CaCertificate:     clientConfig.CaCertificate(),
+			ClientCertificate: clientConfig.ClientCertificate(),
+			ClientKey:         clientConfig.ClientKey(),
+		},
+		Endpoints: endpoints,
+		Nodes:     nodes,
+	}).TalosConfig()
+}
+
+// GenerateTalosconfig exports the talosctl client configuration, including the cluster's client endpoints,
+// as a secret and writes it to path unless path is empty.
+func GenerateTalosconfig(ctx *pulumi.Context, c *talosCluster.Cluster, path string) error {
+	if c.MachineSecrets == nil {
+		return fmt.Errorf("machine secrets are not generated")
+	}
+
+	// Only the exported file reaches the cluster by name, the pipeline's own talosctl calls keep to the node IPs
+	talosconfig := talosConfig(ctx, c, c.ClientEndpoints)
+	if path != "" {
+		talosconfig = talosconfig.ApplyT(func(talosconfig string) (string, error) {
+			if err := file.WriteToFile(path, talosconfig); err != nil {
+				return "", fmt.Errorf("failed to write %s: %w", path, err)
+			}
+			return talosconfig, nil
+		}).(pulumi.StringOutput)
+	}
+
+	ctx.Export("Talosconfig", pulumi.ToSecret(talosconfig))
+	return nil
+}
@@ -0,0 +1,343 @@
+package talos
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"proxmox-talos/internal/config"
+	"proxmox-talos/internal/types"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+	"sigs.k8s.io/yaml"
+)
+
+// partialsDir holds the named templates that every patch template can include.
+const partialsDir = "partials"
+
+// TemplateContext is the data the talos-config templates are rendered with.
+type TemplateContext struct {
+	// Name is the node name.
+	Name string
+	// Role is the node role, controlplane or worker.
+	Role string
+	// Pool is the name of the node's pool and Index the node's position in it.
+	Pool  string
+	Index int
+	// IP is the node's static address without prefix, empty if the node uses DHCP.
+	IP string
+	// Address is the node's static address in CIDR notation, empty if the node uses DHCP.
+	Address string
+	// Host is the Proxmox host running the node's VM.
+	Host        string
+	IsBootstrap bool
+	Labels      map[string]string
+	Cluster     ClusterContext
+	Versions    VersionContext
+	// Vars holds the user-defined templateVars from the stack configuration.
+	Vars map[string]any
+}
+
+// ClusterContext describes the cluster in the template context.
+type ClusterContext struct {
+	Name string
+	// Endpoint is the Kubernetes API endpoint URL.
+	Endpoint string
+	// VIP is the IP of the apiVIP host, empty if the host is a name.
+	VIP string
+}
+
+// VersionContext holds the Talos and Kubernetes versions in the template context.
+type VersionContext struct {
+	Talos      string
+	Kubernetes string
+}
+
+// NewClusterTemplateContext builds the template context of cluster-wide templates such as manifests,
+// which has no node fields.
+func NewClusterTemplateContext(cfg *config.ClusterConfig, cluster *talosCluster.Cluster) TemplateContext {
+	vip := ""
+	if addr := cfg.VIP(); addr.IsValid() {
+		vip = addr.String()
+	}
+
+	return TemplateContext{
+		Cluster: ClusterContext{
+			Name:     cluster.Name,
+			Endpoint: cluster.KubernetesAPI,
+			VIP:      vip,
+		},
+		Versions: VersionContext{
+			Talos:      cluster.TalosVersion,
+			Kubernetes: cluster.KubernetesVersion,
+		},
+		Vars: cfg.TemplateVars,
+	}
+}
+
+// NewTemplateContext builds the template context of a node.
+func NewTemplateContext(cfg *config.ClusterConfig, cluster *talosCluster.Cluster, node types.Node) TemplateContext {
+	index := 0
+	for _, other := range cluster.Nodes {
+		if other == node {
+			break
+		}
+		if other.Pool() == node.Pool() {
+			index++
+		}
+	}
+
+	ip := ""
+	if prefix, err := netip.ParsePrefix(node.Address()); err == nil {
+		ip = prefix.Addr().String()
+	}
+
+	data := NewClusterTemplateContext(cfg, cluster)
+	data.Name = node.Name()
+	data.Role = node.Type().String()
+	data.Pool = node.Pool().String()
+	data.Index = index
+	data.IP = ip
+	data.Address = node.Address()
+	data.Host = node.Host()
+	data.IsBootstrap = node.IsBootstrap()
+	data.Labels = node.Pool().Labels
+	return data
+}
+
+// newTemplate creates a template with the function library and the partials found in dir.
+func newTemplate(name, dir string) (*template.Template, error) {
+	tmpl := template.New(name)
+	tmpl.Funcs(templateFuncs(tmpl))
+
+	partials, err := filepath.Glob(filepath.Join(dir, partialsDir, "*.tmpl"))
+	if err != nil {
+		return nil, err
+	}
+	for _, partial := range partials {
+		content, err := os.ReadFile(partial)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read partial %s: %w", partial, err)
+		}
+		// Every partial can be included by its file name and defines further named templates
+		partialName := strings.TrimSuffix(filepath.Base(partial), ".tmpl")
+		if _, err := tmpl.New(partialName).Parse(string(content)); err != nil {
+			return nil, fmt.Errorf("failed to parse partial %s: %w", partial, err)
+		}
+	}
+	return tmpl, nil
+}
+
+// renderTemplate renders the template file at path with data. It can include the partials in configDir.
+func renderTemplate(path string, data TemplateContext) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	tmpl, err := newTemplate(path, configDir)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmpl.Parse(string(content)); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s: %w", path, err)
+	}
+	return rendered.Bytes(), nil
+}
+
+// templateFuncs returns the Sprig-like function library available in templates.
+// include renders a named template of tmpl to a string so that it can be piped.
+func templateFuncs(tmpl *template.Template) template.FuncMap {
+	return template.FuncMap{
+		"include": func(name string, data any) (string, error) {
+			var out bytes.Buffer
+			if err := tmpl.ExecuteTemplate(&out, name, data); err != nil {
+				return "", err
+			}
+			return out.String(), nil
+		},
+		"required": func(message string, v any) (any, error) {
+			if isEmpty(v) {
+				return nil, fmt.Errorf("%s", message)
+			}
+			return v, nil
+		},
+		"fail": func(message string) (string, error) {
+			return "", fmt.Errorf("%s", message)
+		},
+
+		// Defaults and conditionals
+		"default": func(def, v any) any {
+			if isEmpty(v) {
+				return def
+			}
+			return v
+		},
+		"empty": isEmpty,
+		"coalesce": func(values ...any) any {
+			for _, v := range values {
+				if !isEmpty(v) {
+					return v
+				}
+			}
+			return nil
+		},
+		"ternary": func(yes, no any, condition bool) any {
+			if condition {
+				return yes
+			}
+			return no
+		},
+
+		// Strings
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, v any) string {
+			return strings.Join(toStrings(v), sep)
+		},
+		"repeat":  func(count int, s string) string { return strings.Repeat(s, count) },
+		"quote":   func(v any) string { return fmt.Sprintf("%q", fmt.Sprint(v)) },
+		"squote":  func(v any) string { return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'" },
+		"indent":  indent,
+		"nindent": func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+		"b64enc":  func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) (string, error) {
+			out, err := base64.StdEncoding.DecodeString(s)
+			return string(out), err
+		},
+
+		// Encoding
+		"toYaml": func(v any) (string, error) {
+			out, err := yaml.Marshal(v)
+			return strings.TrimSuffix(string(out), "\n"), err
+		},
+		"toJson": func(v any) (string, error) {
+			out, err := json.Marshal(v)
+			return string(out), err
+		},
+		"fromJson": func(s string) (any, error) {
+			var v any
+			err := json.Unmarshal([]byte(s), &v)
+			return v, err
+		},
+
+		// Lists and dicts
+		"list": func(values ...any) []any { return values },
+		"dict": func(pairs ...any) (map[string]any, error) {
+			if len(pairs)%2 != 0 {
+				return nil, fmt.Errorf("dict needs key and value pairs")
+			}
+			d := make(map[string]any, len(pairs)/2)
+			for i := 0; i < len(pairs); i += 2 {
+				d[fmt.Sprint(pairs[i])] = pairs[i+1]
+			}
+			return d, nil
+		},
+		"get": func(d map[string]any, key string) any { return d[key] },
+		"hasKey": func(d map[string]any, key string) bool {
+			_, ok := d[key]
+			return ok
+		},
+		"keys": func(d map[string]any) []string {
+			keys := make([]string, 0, len(d))
+			for k := range d {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return keys
+		},
+		"until": func(count int) []int {
+			seq := make([]int, count)
+			for i := range seq {
+				seq[i] = i
+			}
+			return seq
+		},
+
+		// Arithmetic
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+		"mul": func(a, b int) int { return a * b },
+		"div": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return a / b, nil
+		},
+		"mod": func(a, b int) (int, error) {
+			if b == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return a % b, nil
+		},
+
+		// Networking
+		"cidrHost": func(index int, cidr string) (string, error) {
+			prefix, err := netip.ParsePrefix(cidr)
+			if err != nil {
+				return "", err
+			}
+			addr := prefix.Masked().Addr()
+			for i := 0; i < index; i++ {
+				addr = addr.Next()
+			}
+			if !prefix.Contains(addr) {
+				return "", fmt.Errorf("host %d is outside of %s", index, cidr)
+			}
+			return addr.String(), nil
+		},
+	}
+}
+
+// isEmpty returns true for nil and for the zero value of v's type, including empty collections.
+func isEmpty(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return rv.Len() == 0
+	default:
+		return rv.IsZero()
+	}
+}
+
+// toStrings converts a list into its items' string representations.
+func toStrings(v any) []string {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []string{fmt.Sprint(v)}
+	}
+	out := make([]string, rv.Len())
+	for i := range out {
+		out[i] = fmt.Sprint(rv.Index(i).Interface())
+	}
+	return out
+}
+
+// indent indents every line of s by spaces.
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
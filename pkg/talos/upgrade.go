@@ -0,0 +1,129 @@
+package talos
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-command/sdk/go/command/local"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"proxmox-talos/internal/types"
+	talosCluster "proxmox-talos/internal/types/talos/cluster"
+)
+
+// UpgradeOutput is the stack output holding the installer image every node runs.
+const UpgradeOutput = "TalosUpgrade"
+
+// recordImageScript records the image a freshly installed node already runs.
+const recordImageScript = `printf '%s' "$IMAGE"`
+
+// upgradeScript upgrades the node to $IMAGE with talosctl unless it already runs it.
+// The client configuration is read from stdin so it never touches the command line.
+const upgradeScript = `set -eu
+if [ "${PULUMI_COMMAND_STDOUT:-}" = "$IMAGE" ]; then
+	printf '%s' "$IMAGE"
+	exit 0
+fi
+talosconfig=$(mktemp)
+trap 'rm -f "$talosconfig"' EXIT
+cat > "$talosconfig"
+talosctl --talosconfig "$talosconfig" --nodes "$NODE" --endpoints "$NODE" upgrade --image "$IMAGE" --wait >&2
+printf '%s' "$IMAGE"`
+
+// Upgrader rolls Talos version and schematic changes out to the nodes one at a time.
+type Upgrader struct {
+	ctx      *pulumi.Context
+	cluster  *talosCluster.Cluster
+	images   map[string]*Image
+	previous map[string]string
+}
+
+// NewUpgrader creates an Upgrader. previous holds the installer image of every node after the
+// last deployment, as exported in UpgradeOutput; nodes missing from it are treated as up to date.
+func NewUpgrader(ctx *pulumi.Context, cluster *talosCluster.Cluster, images map[string]*Image, previous map[string]string) *Upgrader {
+	return &Upgrader{
+		ctx:      ctx,
+		cluster:  cluster,
+		images:   images,
+		previous: previous,
+	}
+}
+
+// upgradeOrder returns the nodes in rollout order: workers, then control planes, with the bootstrap node last.
+func (u *Upgrader) upgradeOrder() []types.Node {
+	var workers, controlPlanes []types.Node
+	var bootstrap types.Node
+	for _, node := range u.cluster.Nodes {
+		switch {
+		case node.IsBootstrap():
+			bootstrap = node
+		case node.Type() == types.ControlPlane:
+			controlPlanes = append(controlPlanes, node)
+		default:
+			workers = append(workers, node)
+		}
+	}
+
+	order := append(workers, controlPlanes...)
+	if bootstrap != nil {
+		order = append(order, bootstrap)
+	}
+	return order
+}
+
+// Rollout creates one upgrade step per node. Each step waits for the previous one and for a
+// cluster health check, so the rollout stops at the first node that fails to upgrade.
+// applied maps node names to the resources that must finish before the node is upgraded.
+// It returns an output that resolves once the last node has been upgraded.
+func (u *Upgrader) Rollout(applied map[string]pulumi.Resource) (pulumi.StringOutput, error) {
+	talosConfig := pulumi.ToSecret(TalosConfig(u.ctx, u.cluster)).(pulumi.StringOutput)
+
+	order := u.upgradeOrder()
+	status := pulumi.StringMap{}
+	var previousStep pulumi.StringOutput = pulumi.String("").ToStringOutput()
+	for i, node := range order {
+		image, ok := u.images[node.Pool().Schematic]
+		if !ok {
+			return pulumi.String("").ToStringOutput(), fmt.Errorf("no image for schematic %s", node.Pool().Schematic)
+		}
+		target := image.Installer(u.cluster.TalosVersion)
+
+		name := node.Name()
+		step := i + 1
+		needsUpgrade := target.ApplyT(func(target string) bool {
+			current, ok := u.previous[name]
+			if ok && current != target {
+				u.ctx.Log.Info(fmt.Sprintf("Upgrading node %s from %s to %s (step %d/%d)", name, current, target, step, len(order)), nil)
+				return true
+			}
+			return false
+		}).(pulumi.BoolOutput)
+
+		// Check the cluster before touching a node, so an unhealthy cluster stops the rollout
+		gate := HealthGate(u.ctx, u.cluster, previousStep, needsUpgrade)
+
+		var dependsOn []pulumi.Resource
+		if apply, ok := applied[name]; ok {
+			dependsOn = append(dependsOn, apply)
+		}
+
+		cmd, err := local.NewCommand(u.ctx, fmt.Sprintf("%s-talos-upgrade", name), &local.CommandArgs{
+			Create: pulumi.String(recordImageScript),
+			Update: pulumi.String(upgradeScript),
+			Stdin:  talosConfig,
+			Environment: pulumi.StringMap{
+				"NODE":  node.IP(),
+				"IMAGE": target,
+				// Resolves to "" once the health gate passed, so it only orders the steps
+				"HEALTH_GATE": gate.ApplyT(func(string) string { return "" }).(pulumi.StringOutput),
+			},
+		}, pulumi.DependsOn(dependsOn))
+		if err != nil {
+			return pulumi.String("").ToStringOutput(), fmt.Errorf("creating upgrade step for node %s: %w", name, err)
+		}
+
+		previousStep = cmd.Stdout
+		status[name] = cmd.Stdout
+	}
+
+	u.ctx.Export(UpgradeOutput, status)
+	return previousStep, nil
+}
@@ -0,0 +1,307 @@
+package talos
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"proxmox-talos/internal/types"
+)
+
+// ValidationError is a schema violation at a line of a machine config source.
+type ValidationError struct {
+	File    string
+	Line    int
+	Path    string
+	Message string
+}
+
+// Error returns the error in the file:line form editors understand.
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s", e.File, e.Line, e.Path, e.Message)
+}
+
+// ValidationErrors collects every schema violation of a machine config source.
+type ValidationErrors []ValidationError
+
+// Error returns one violation per line.
+func (e ValidationErrors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateConfig checks every document of a machine config or patch against the v1alpha1 schema
+// of the Talos version and rejects fields the schema does not know. name is the source reported
+// in errors and lines refer to content as passed; ValidateTemplate reports template lines instead.
+func ValidateConfig(name string, content []byte, talosVersion string) error {
+	version, err := types.ParseVersion(talosVersion)
+	if err != nil {
+		return fmt.Errorf("talos %w", err)
+	}
+
+	v := &validator{file: name, minor: version.Minor}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if len(doc.Content) == 0 {
+			continue
+		}
+		v.validateDocument(doc.Content[0])
+	}
+
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+// ValidatePatches merges the known patches of a node in order and validates the result like
+// ValidateConfig, without the config Talos generates. It runs during preview, when the generated
+// config can still be unknown. Patches with $patch directives or JSON6902 operations edit the
+// generated config and are left to the check of the full config.
+func ValidatePatches(name string, patches [][]byte, talosVersion string) error {
+	var sources []patchSource
+	for i, patch := range patches {
+		appliesToBase, err := patchesGeneratedConfig(patch)
+		if err != nil {
+			return fmt.Errorf("%s: patch %d: %w", name, i+1, err)
+		}
+		if !appliesToBase {
+			sources = append(sources, patchSource{Name: fmt.Sprintf("%s patch %d", name, i+1), Content: patch})
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+
+	merged, err := mergeSources(sources)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return ValidateConfig(name, []byte(merged), talosVersion)
+}
+
+// ValidateTemplate validates the rendered output of the template at path like ValidateConfig and
+// reports every violation at the line of the template source the rendered line comes from.
+func ValidateTemplate(path string, source, rendered []byte, talosVersion string) error {
+	err := ValidateConfig(path, rendered, talosVersion)
+	var violations ValidationErrors
+	if !errors.As(err, &violations) {
+		return err
+	}
+
+	lines := templateLines(source, rendered)
+	mapped := make(ValidationErrors, len(violations))
+	for i, violation := range violations {
+		if violation.Line >= 1 && violation.Line <= len(lines) {
+			violation.Line = lines[violation.Line-1]
+		}
+		mapped[i] = violation
+	}
+	return mapped
+}
+
+// templateLines maps every line of rendered, by index, to the line of the template source it comes
+// from. Lines the template holds verbatim are matched by their longest common subsequence; a line
+// produced by an action is attributed to the source line at the same distance from the last match,
+// without passing the next match.
+func templateLines(source, rendered []byte) []int {
+	src := strings.Split(string(source), "\n")
+	out := strings.Split(string(rendered), "\n")
+	for i := range src {
+		src[i] = strings.TrimRight(src[i], " \t\r")
+	}
+	for i := range out {
+		out[i] = strings.TrimRight(out[i], " \t\r")
+	}
+
+	// common[i][j] is the length of the longest common subsequence of out[i:] and src[j:]
+	common := make([][]int, len(out)+1)
+	for i := range common {
+		common[i] = make([]int, len(src)+1)
+	}
+	for i := len(out) - 1; i >= 0; i-- {
+		for j := len(src) - 1; j >= 0; j-- {
+			switch {
+			case out[i] == src[j]:
+				common[i][j] = common[i+1][j+1] + 1
+			case common[i+1][j] >= common[i][j+1]:
+				common[i][j] = common[i+1][j]
+			default:
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	// matched holds the 1-based source line of every verbatim output line, 0 for the others
+	matched := make([]int, len(out))
+	for i, j := 0, 0; i < len(out) && j < len(src); {
+		switch {
+		case out[i] == src[j]:
+			matched[i] = j + 1
+			i++
+			j++
+		case common[i+1][j] >= common[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	lines := make([]int, len(out))
+	previousOut, previousSrc := -1, 0
+	for i := range out {
+		if matched[i] > 0 {
+			lines[i] = matched[i]
+			previousOut, previousSrc = i, matched[i]
+			continue
+		}
+
+		line := previousSrc + i - previousOut
+		if previousOut < 0 {
+			line = i + 1
+		}
+		for k := i + 1; k < len(out); k++ {
+			if matched[k] > 0 {
+				line = min(line, matched[k]-1)
+				break
+			}
+		}
+		lines[i] = max(line, previousSrc, 1)
+	}
+	return lines
+}
+
+// validator collects the schema violations of one source.
+type validator struct {
+	file   string
+	minor  int
+	errors ValidationErrors
+}
+
+// fail records a violation at node.
+func (v *validator) fail(node *yaml.Node, path, format string, args ...any) {
+	v.errors = append(v.errors, ValidationError{File: v.file, Line: node.Line, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateDocument validates one document. Only the v1alpha1 config is checked field by field;
+// other document kinds need an apiVersion and JSON6902 operations an op and path.
+func (v *validator) validateDocument(node *yaml.Node) {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		for _, operation := range node.Content {
+			if operation.Kind != yaml.MappingNode || mappingValue(operation, "op") == nil || mappingValue(operation, "path") == nil {
+				v.fail(operation, "", "JSON6902 operation needs op and path")
+			}
+		}
+	case yaml.MappingNode:
+		if kind := mappingValue(node, "kind"); kind != nil {
+			if mappingValue(node, "apiVersion") == nil {
+				v.fail(node, "", "%s document has no apiVersion", kind.Value)
+			}
+			return
+		}
+		v.validate(node, machineConfigSchema, "")
+	default:
+		v.fail(node, "", "document must be an object or a list of JSON6902 operations")
+	}
+}
+
+// validate checks node against field.
+func (v *validator) validate(node *yaml.Node, field *schemaField, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if field.Since > v.minor {
+		v.fail(node, path, "requires Talos v1.%d or later", field.Since)
+		return
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+
+	switch field.Kind {
+	case kindAny:
+	case kindString:
+		if node.Kind != yaml.ScalarNode {
+			v.fail(node, path, "expected %s", field.Kind)
+			return
+		}
+		if field.Check != nil {
+			if err := field.Check(node.Value); err != nil {
+				v.fail(node, path, "%s", err)
+			}
+		}
+	case kindBool, kindInt:
+		tag := "!!bool"
+		if field.Kind == kindInt {
+			tag = "!!int"
+		}
+		if node.Kind != yaml.ScalarNode || node.Tag != tag {
+			v.fail(node, path, "expected %s, got %q", field.Kind, node.Value)
+		}
+	case kindList:
+		if node.Kind != yaml.SequenceNode {
+			v.fail(node, path, "expected %s", field.Kind)
+			return
+		}
+		for i, item := range node.Content {
+			if isDirectiveOnly(item) {
+				continue
+			}
+			v.validate(item, field.Elem, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case kindObject, kindMap:
+		if node.Kind != yaml.MappingNode {
+			v.fail(node, path, "expected %s", field.Kind)
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == patchDirective {
+				continue
+			}
+			childPath := joinPath(path, key.Value)
+			child := field.Elem
+			if field.Kind == kindObject {
+				child = field.Fields[key.Value]
+			}
+			if child == nil {
+				v.fail(key, childPath, "unknown field")
+				continue
+			}
+			v.validate(value, child, childPath)
+		}
+	}
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// isDirectiveOnly returns true for a list item that only holds a $patch directive.
+func isDirectiveOnly(node *yaml.Node) bool {
+	return node.Kind == yaml.MappingNode && len(node.Content) == 2 && node.Content[0].Value == patchDirective
+}
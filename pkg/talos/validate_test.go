@@ -0,0 +1,117 @@
+package talos
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		version string
+		err     string
+	}{
+		{
+			name:    "valid config",
+			content: "machine:\n  network:\n    hostname: a\n    interfaces:\n      - interface: eth0\n        addresses: [10.0.0.2/24]\n        mtu: 1500\n",
+		},
+		{
+			name:    "unknown field",
+			content: "machine:\n  network:\n    hostnam: a\n",
+			err:     "node:3: machine.network.hostnam: unknown field",
+		},
+		{
+			name:    "wrong type",
+			content: "machine:\n  network:\n    interfaces:\n      - interface: eth0\n        mtu: large\n",
+			err:     `node:5: machine.network.interfaces[0].mtu: expected integer, got "large"`,
+		},
+		{
+			name:    "bad CIDR",
+			content: "cluster:\n  network:\n    podSubnets: [10.244.0.0/33]\n",
+			err:     `node:3: cluster.network.podSubnets[0]: invalid CIDR "10.244.0.0/33"`,
+		},
+		{
+			name:    "field of a later Talos version",
+			content: "machine:\n  features:\n    imageCache:\n      localEnabled: true\n",
+			version: "v1.9.0",
+			err:     "node:4: machine.features.imageCache: requires Talos v1.10 or later",
+		},
+		{
+			name:    "field of the Talos version",
+			content: "machine:\n  features:\n    imageCache:\n      localEnabled: true\n",
+			version: "v1.10.0",
+		},
+		{
+			name:    "other document kinds need an apiVersion",
+			content: "kind: Layer2VIPConfig\nname: 10.0.0.1\n",
+			err:     "node:1: Layer2VIPConfig document has no apiVersion",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := tt.version
+			if version == "" {
+				version = "v1.10.0"
+			}
+
+			err := ValidateConfig("node", []byte(tt.content), version)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("ValidateConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ValidateConfig error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidatePatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		patches []string
+		err     string
+	}{
+		{
+			name:    "valid patches merge",
+			patches: []string{`{"machine":{"network":{"hostname":"a"}}}`, `{"machine":{"network":{"nameservers":["10.0.0.1"]}}}`},
+		},
+		{
+			name:    "an invalid field is reported on the merged patches",
+			patches: []string{`{"machine":{"network":{"hostname":"a"}}}`, `{"machine":{"network":{"hostnam":"b"}}}`},
+			err:     "machine.network.hostnam: unknown field",
+		},
+		{
+			name:    "JSON6902 operations are left to the full config",
+			patches: []string{`[{"op":"remove","path":"/cluster/proxy"}]`, `{"machine":{"type":"worker"}}`},
+		},
+		{
+			name:    "directives are left to the full config",
+			patches: []string{`{"cluster":{"proxy":{"$patch":"delete"}}}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patches := make([][]byte, len(tt.patches))
+			for i, patch := range tt.patches {
+				patches[i] = []byte(patch)
+			}
+
+			err := ValidatePatches("node", patches, "v1.10.0")
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("ValidatePatches: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ValidatePatches error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
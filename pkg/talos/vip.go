@@ -2,35 +2,42 @@ package talos
 
 import (
 	"encoding/json"
-	"sigs.k8s.io/yaml"
+	"fmt"
+	"net/netip"
 )
 
-// Config represents the Talos network VIP configuration.
-type Config struct {
+// VIPPatch represents the shared virtual IP of the control plane interface.
+type VIPPatch struct {
 	Machine struct {
 		Network struct {
-			Interfaces []struct {
-				DeviceSelector struct {
-					Driver string `yaml:"driver" json:"driver"`
-				} `yaml:"deviceSelector" json:"deviceSelector"`
-				Vip struct {
-					IP string `yaml:"ip" json:"ip"`
-				} `yaml:"vip" json:"vip"`
-			} `yaml:"interfaces" json:"interfaces"`
-		} `yaml:"network" json:"network"`
-	} `yaml:"machine" json:"machine"`
+			Interfaces []VIPInterface `json:"interfaces"`
+		} `json:"network"`
+	} `json:"machine"`
 }
 
-// Marshal converts YAML bytes to JSON bytes for the Config struct.
-func (c *Config) Marshal(b []byte) []byte {
-	var config Config
-	if err := yaml.Unmarshal(b, &config); err != nil {
-		return []byte("")
-	}
+// VIPInterface represents a Talos network interface holding the shared virtual IP.
+type VIPInterface struct {
+	DeviceSelector map[string]string `json:"deviceSelector"`
+	VIP            struct {
+		IP string `json:"ip"`
+	} `json:"vip"`
+}
 
-	jsonData, err := json.Marshal(config)
+// NewVIPPatch creates a JSON patch that announces ip on the interface matched by selector,
+// or on the default interface if selector is empty.
+func NewVIPPatch(ip string, selector map[string]string) ([]byte, error) {
+	addr, err := netip.ParseAddr(ip)
 	if err != nil {
-		return []byte("")
+		return nil, fmt.Errorf("invalid VIP %q: %w", ip, err)
+	}
+	if len(selector) == 0 {
+		selector = DefaultDeviceSelector
 	}
-	return jsonData
+
+	iface := VIPInterface{DeviceSelector: selector}
+	iface.VIP.IP = addr.String()
+
+	patch := VIPPatch{}
+	patch.Machine.Network.Interfaces = []VIPInterface{iface}
+	return json.Marshal(patch)
 }